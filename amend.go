@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// Fold the staged changes into a planned commit, in the queued diff and in the local commit
+// -amend can also change the message, -fixup keeps it. Both keep the due date unless -date is given
+func Amend(opts *commitOptions) error {
+	id := opts.amend
+	switch {
+	case opts.amend != "" && opts.fixup != "":
+		return usageErrorf("-amend and -fixup can't be used together")
+	case opts.fixup != "" && opts.message != "":
+		return usageErrorf("-fixup keeps the message, use -amend to change it")
+	case opts.fixup != "":
+		id = opts.fixup
+	}
+	if opts.branch != "" || opts.remote != "" || opts.upstream != "" {
+		return usageErrorf("the amended commit stays on its branch, -branch, -remote and -upstream can't be changed")
+	}
+	r, err := git.PlainOpen(".")
+	if err != nil {
+		return gitError(fmt.Errorf("could not open the git repository: %w", err))
+	}
+	entry, err := findEntry(id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case entry.Type != typeCommit:
+		return fmt.Errorf("Sir, %v is a planned push, there is no commit to amend", entry.ID)
+	case entry.State == stateProcessing:
+		return fmt.Errorf("Sir, %v is being pushed right now, it's too late to amend it", entry.ID)
+	case entry.State == statePushed:
+		return fmt.Errorf("Sir, %v is already on %v/%v, it's too late to amend it", entry.ID, entry.Remote, entry.Upstream)
+	case entry.Commit == "":
+		return fmt.Errorf("Sir, %v was planned by an older version of gitplan, its local commit is unknown", entry.ID)
+	}
+	err = refuseStagedDataDir(opts.all || len(opts.paths) > 0)
+	if err != nil {
+		return err
+	}
+	branch, err := targetBranch(r, "")
+	if err != nil {
+		return err
+	}
+	if branch != entry.Branch {
+		return fmt.Errorf("Sir, %v is planned on %v, checkout %v to amend it", entry.ID, entry.Branch, entry.Branch)
+	}
+	if exec.Command("git", "merge-base", "--is-ancestor", entry.Commit, "HEAD").Run() != nil {
+		return fmt.Errorf("Sir, the local commit of %v (%v) is not on %v anymore", entry.ID, entry.Commit[:7], branch)
+	}
+	changes := checkChanges(opts) == nil
+	if !changes && opts.message == "" && opts.delay.raw == "" {
+		return errors.New("nothing to amend, make sure to git add your modifications")
+	}
+
+	// The entries of the commits made after it are rewritten too, their local commits change
+	out, err := exec.Command("git", "rev-list", "--reverse", entry.Commit+"..HEAD").Output()
+	if err != nil {
+		return gitError(fmt.Errorf("could not list the commits after %v: %w", entry.Commit[:7], err))
+	}
+	later := strings.Fields(string(out))
+	entries, _, err := loadEntries()
+	if err != nil {
+		return err
+	}
+	rewritten := map[string]*Entry{entry.Commit: entry}
+	for _, e := range entries {
+		for _, sha := range later {
+			if e.Commit == sha {
+				if e.State == stateProcessing {
+					return fmt.Errorf("Sir, %v comes after it and is being pushed right now, it's too late to amend %v", e.ID, entry.ID)
+				}
+				rewritten[sha] = e
+			}
+		}
+	}
+
+	oldHead, indexTree, err := localState()
+	if err != nil {
+		return err
+	}
+	commits, err := amendLocalCommit(entry, oldHead, opts)
+	if err != nil {
+		return err
+	}
+	if len(commits) != len(later)+1 {
+		rollbackCommit(oldHead, commits[len(commits)-1], indexTree)
+		return gitError(fmt.Errorf("expected %v commits after rewriting %v, found %v, the local commits were put back", len(later)+1, entry.Commit[:7], len(commits)))
+	}
+
+	// Entries are kept as they were, to put them back if one can't be written
+	restores := []func(){}
+	restore := func() {
+		for _, r := range restores {
+			r()
+		}
+	}
+	newHead := commits[len(commits)-1]
+	for i, old := range append([]string{entry.Commit}, later...) {
+		e, ok := rewritten[old]
+		if !ok {
+			continue
+		}
+		diff, err := exec.Command("git", "diff", commits[i]+"^", commits[i]).Output()
+		var r func()
+		if err == nil {
+			r, err = e.backup()
+		}
+		if err == nil {
+			restores = append(restores, r)
+			e.Commit = commits[i]
+			if e == entry {
+				if opts.message != "" {
+					e.Message = opts.message
+				}
+				if opts.delay.raw != "" {
+					e.Date = opts.delay.dueDate()
+				}
+				// The failure may be what the amend fixes
+				e.State, e.Attempts, e.LastAttempt, e.LastError = statePending, 0, 0, ""
+			}
+			err = e.write(diff)
+		}
+		if err != nil {
+			restore()
+			rollbackErr := rollbackCommit(oldHead, newHead, indexTree)
+			if rollbackErr != nil {
+				return fmt.Errorf("could not update %v: %v. The local commits could not be put back either: %w", e.ID, err, rollbackErr)
+			}
+			return fmt.Errorf("could not update %v, nothing was amended: %w", e.ID, err)
+		}
+	}
+	fmt.Printf("%v amended, planned %v: %v\n", entry.ID, relativeDate(entry.Due(), time.Now()), strings.SplitN(entry.Message, "\n", 2)[0])
+
+	return nil
+}
+
+// Fold the changes into the local commit of the entry, and replay the commits made after it
+// Returns the rewritten commit followed by the replayed ones, oldest first
+func amendLocalCommit(entry *Entry, head string, opts *commitOptions) ([]string, error) {
+	args := []string{"commit", "--quiet"}
+	if entry.Commit == head {
+		args = append(args, "--amend")
+		if opts.message != "" {
+			args = append(args, "-m", opts.message)
+		} else {
+			args = append(args, "--no-edit")
+		}
+	} else {
+		// An "amend!" commit replaces the message of the commit it is squashed into, a "fixup!" one keeps it
+		args = append(args, "--allow-empty")
+		if opts.message != "" {
+			args = append(args, "-m", "amend! "+entry.Commit, "-m", opts.message)
+		} else {
+			args = append(args, "-m", "fixup! "+entry.Commit)
+		}
+	}
+	if opts.all {
+		args = append(args, "--all")
+	}
+	args = append(append(args, "--"), opts.paths...)
+	// The entries are updated here, not by the post-rewrite hook
+	env := append(os.Environ(), hookSkipEnv+"=1")
+	cmd := exec.Command("git", args...)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, gitError(fmt.Errorf("something went wrong committing your changes: %w: %v", err, strings.TrimSpace(string(out))))
+	}
+	if entry.Commit != head {
+		cmd = exec.Command("git", "-c", "sequence.editor=:", "rebase", "--quiet", "--interactive", "--autosquash", "--autostash", entry.Commit+"^")
+		cmd.Env = append(env, "GIT_EDITOR=:")
+		out, err = cmd.CombinedOutput()
+		if err != nil {
+			exec.Command("git", "rebase", "--abort").Run()
+			exec.Command("git", "reset", "--quiet", "--soft", head).Run()
+			return nil, fmt.Errorf("Sir, the commits after %v don't apply on the amended one anymore, nothing was amended: %v", entry.Commit[:7], strings.TrimSpace(string(out)))
+		}
+	}
+	out, err = exec.Command("git", "rev-list", "--reverse", entry.Commit+"^..HEAD").Output()
+	if err != nil {
+		return nil, gitError(fmt.Errorf("could not list the amended commits: %w", err))
+	}
+
+	return strings.Fields(string(out)), nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// How gitplan authenticates to the remote
+const (
+	authAgent            = "agent"             // keys of the ssh-agent listening on SSH_AUTH_SOCK
+	authKey              = "key"               // a private key file, with its passphrase from the passphrase store
+	authHTTP             = "http"              // HTTPS username and token, the token in the passphrase store
+	authCredentialHelper = "credential-helper" // HTTPS credentials from the credential helpers of git
+)
+
+func validAuth(mode string) bool {
+	switch mode {
+	case authAgent, authKey, authHTTP, authCredentialHelper:
+		return true
+	}
+
+	return false
+}
+
+// Set during init, so the user is asked whether to trust an unknown host instead of failing
+var trustOnFirstUse = false
+
+// The host presented a key different from the one that is known for it
+type hostKeyMismatchError struct {
+	host string
+}
+
+func (e *hostKeyMismatchError) Error() string {
+	return fmt.Sprintf("the host key of %v changed, someone could be impersonating it, refusing to connect. Check the key and fix %v or ~/.ssh/known_hosts", e.host, knownHostsFile)
+}
+
+// GIT_SSH_COMMAND making the git commands run by gitplan check the host keys against ~/.ssh/known_hosts and .gitplan/known_hosts,
+// and use the private key of the config when there is one
+// During init ssh asks whether to trust an unknown host, and adds its key to .gitplan/known_hosts, the first file
+func gitSSHCommand() string {
+	command := os.Getenv("GIT_SSH_COMMAND")
+	if command == "" {
+		command = "ssh"
+	}
+	files := []string{}
+	path, err := filepath.Abs(knownHostsFile)
+	if err == nil {
+		files = append(files, `"`+path+`"`)
+	}
+	home, err := os.UserHomeDir()
+	if err == nil {
+		files = append(files, `"`+filepath.Join(home, ".ssh", "known_hosts")+`"`)
+	}
+	check := "yes"
+	if trustOnFirstUse {
+		check = "ask"
+	}
+
+	command = fmt.Sprintf("%v -o StrictHostKeyChecking=%v -o 'UserKnownHostsFile=%v'", command, check, strings.Join(files, " "))
+	if sshKeyFile != "" {
+		command += fmt.Sprintf(" -i '%v' -o IdentitiesOnly=yes", sshKeyFile)
+	}
+
+	return command
+}
+
+// Build the auth method described by the config, to connect to the remote URL
+func (c *Config) authMethod(remoteURL string) (transport.AuthMethod, error) {
+	user := "git"
+	if r := resolveSSHRemote(remoteURL); r != nil {
+		user = r.user
+	}
+	switch c.Auth {
+	case authAgent:
+		auth := newAgentAuth(user)
+		_, err := auth.Callback()
+		if err != nil {
+			return nil, err
+		}
+		return auth, nil
+	case authHTTP:
+		token, err := loadSecret(c.PassphraseStore, "token", "Access token for "+remoteURL+":")
+		if err != nil {
+			return nil, fmt.Errorf("could not get the token from the %v store: %w", c.PassphraseStore, err)
+		}
+		return &http.BasicAuth{Username: c.Username, Password: token}, nil
+	case authCredentialHelper:
+		return credentialFill(remoteURL, false)
+	}
+	password, err := c.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	auth, err := GenerateAuth(user, c.PrivateKeyFile, password)
+	if err != nil {
+		return nil, fmt.Errorf("generate publickeys failed: %w", err)
+	}
+
+	return auth, nil
+}
+
+// Check if an ssh-agent is running and holds at least one key
+func agentAvailable() bool {
+	signers, err := (&sshAgent{}).signers()
+
+	return err == nil && len(signers) > 0
+}
+
+// Auth method using the keys of the ssh-agent
+// The agent is asked for its keys on every connection, and reconnected to if it went away,
+// so a consumer running for hours survives the agent being restarted
+func newAgentAuth(user string) *gitssh.PublicKeysCallback {
+	a := &sshAgent{}
+
+	return &gitssh.PublicKeysCallback{
+		User:     user,
+		Callback: a.signers,
+	}
+}
+
+// Connection to the ssh-agent listening on SSH_AUTH_SOCK
+type sshAgent struct {
+	mutex  sync.Mutex
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+func (a *sshAgent) signers() ([]ssh.Signer, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.client != nil {
+		signers, err := a.client.Signers()
+		if err == nil {
+			return signers, nil
+		}
+		// The agent may have been restarted, try again with a new connection
+		a.conn.Close()
+		a.client = nil
+	}
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("no ssh-agent available, SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the ssh-agent: %w", err)
+	}
+	client := agent.NewClient(conn)
+	signers, err := client.Signers()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not get the keys of the ssh-agent: %w", err)
+	}
+	if len(signers) == 0 {
+		conn.Close()
+		return nil, errors.New("the ssh-agent has no key, add one with ssh-add")
+	}
+	a.conn, a.client = conn, client
+
+	return signers, nil
+}
+
+// Check if the private key file is protected by a passphrase
+func isKeyEncrypted(privateKeyFile string) (bool, error) {
+	sshKey, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return false, err
+	}
+	_, err = ssh.ParsePrivateKey(sshKey)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return true, nil
+	}
+
+	return false, err
+}
+
+// Generate public keys from private key file and password, to connect as the given user
+// Password can be an empty string
+func GenerateAuth(user string, privateKeyFile string, password string) (*gitssh.PublicKeys, error) {
+	var signer ssh.Signer
+	var err error = nil
+	sshKey, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(password) == 0 {
+		signer, err = ssh.ParsePrivateKey([]byte(sshKey))
+	} else {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(sshKey), []byte(password))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &gitssh.PublicKeys{User: user, Signer: signer}
+
+	return auth, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/gookit/color"
+)
+
+// Check that the planned entries still apply on the remote branches, before they are due
+// The remotes are fetched, then the entries of each branch are replayed in the order the consumer pushes them,
+// on a temporary index starting at the remote branch, so nothing is checked out and the consumer is not disturbed
+func Check() error {
+	if _, err := os.Stat(repoDir); os.IsNotExist(err) {
+		return errors.New("nothing to check, there has never been any commit using gitplan")
+	}
+	entries, invalid, err := loadEntries()
+	if err != nil {
+		return err
+	}
+	for _, e := range invalid {
+		color.Warn.Println("warning: " + e.Error())
+	}
+	err = checkCredentials()
+	if err != nil {
+		return err
+	}
+
+	// Entries of each branch of each remote, in the order the consumer pushes them
+	queues := map[string][]*Entry{}
+	keys := []string{}
+	checked := 0
+	for _, e := range entries {
+		if e.done() {
+			continue
+		}
+		checked++
+		key := e.Remote + "/" + e.Upstream
+		if _, ok := queues[key]; !ok {
+			keys = append(keys, key)
+		}
+		queues[key] = append(queues[key], e)
+	}
+	if checked == 0 {
+		color.Info.Println("Sir, there is nothing left to push, nothing to check")
+		return nil
+	}
+	sort.Strings(keys)
+	fetched := map[string]bool{}
+	conflicts := 0
+	for _, key := range keys {
+		queue := queues[key]
+		sort.SliceStable(queue, func(i, j int) bool {
+			if queue[i].Date != queue[j].Date {
+				return queue[i].Date < queue[j].Date
+			}
+			return lessID(queue[i].ID, queue[j].ID)
+		})
+		remote := queue[0].Remote
+		if !fetched[remote] {
+			fetched[remote] = true
+			_, err := shadowGit("fetch", "--quiet", "--prune", remote).Output()
+			if err != nil {
+				color.Warn.Println(fmt.Sprintf("Could not fetch %v, checking against what was fetched last: %v", remote, commandError(err)))
+			}
+		}
+		n, err := checkQueue(queue)
+		if err != nil {
+			return err
+		}
+		conflicts += n
+	}
+	if conflicts > 0 {
+		return fmt.Errorf("Sir, %v of the %v planned entries would fail, fix them before they are due", conflicts, checked)
+	}
+	color.Info.Println(fmt.Sprintf("Sir, the %v planned entries apply on their remote branches", checked))
+
+	return nil
+}
+
+// The token or the private key the consumer would use, for the fetches
+// With the other kinds of authentication, git finds the credentials itself
+func checkCredentials() error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if config.Auth != authHTTP && config.Auth != authKey {
+		return nil
+	}
+	if config.Remote == "" {
+		config.Remote = "origin"
+	}
+	r, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return gitError(fmt.Errorf("%v is not a repository: %w", repoDir, err))
+	}
+	remote, err := r.Remote(config.Remote)
+	if err != nil {
+		return gitError(fmt.Errorf("could not find the %v remote of %v: %w", config.Remote, repoDir, err))
+	}
+	auth, err := config.authMethod(remote.Config().URLs[0])
+	if err != nil {
+		return authError(err)
+	}
+
+	return authError(config.shareAuth(remote.Config().URLs[0], auth))
+}
+
+// Replay the entries of one remote branch, and print whether each would be pushed
+// Returns how many would fail
+func checkQueue(queue []*Entry) (int, error) {
+	dir, err := os.MkdirTemp("", "gitplan-check-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	indexGit := func(args ...string) *exec.Cmd {
+		cmd := shadowGit(args...)
+		cmd.Env = append(cmd.Env, "GIT_INDEX_FILE="+filepath.Join(dir, "index"))
+		return cmd
+	}
+	remoteRef := "refs/remotes/" + queue[0].Remote + "/" + queue[0].Upstream
+	out, _ := shadowGit("rev-parse", "--verify", "--quiet", remoteRef).Output()
+	tip := strings.TrimSpace(string(out))
+	// Commit the next diff applies on, the remote branch or the fork point it is created from,
+	// read into the index when a diff needs it
+	base := tip
+	if base == "" {
+		base = queue[0].Base
+	}
+	indexed := false
+
+	conflicts := 0
+	for _, e := range queue {
+		target := e.Remote + "/" + e.Upstream
+		var problems []string
+		switch {
+		case e.Type == typePush:
+			problems = checkPush(e, tip)
+			if len(problems) == 0 {
+				// What comes next is pushed on top of the branch
+				out, _ = shadowGit("rev-parse", "--verify", "--quiet", e.pushRef()).Output()
+				if e.Commit == "" {
+					out, _ = exec.Command("git", "rev-parse", "--verify", "--quiet", "refs/heads/"+e.Branch).Output()
+				}
+				base = strings.TrimSpace(string(out))
+				tip = base
+				indexed = false
+			}
+		case !indexed && base == "":
+			problems = []string{fmt.Sprintf("%v doesn't exist on %v", e.Upstream, e.Remote)}
+		case alreadyOnRemote(e):
+			fmt.Printf("%v is already on %v, it won't be pushed again: %v\n", e.ID, target, strings.SplitN(e.Message, "\n", 2)[0])
+			continue
+		default:
+			if !indexed {
+				err = indexGit("read-tree", base).Run()
+				if err != nil {
+					return 0, gitError(fmt.Errorf("could not read %v: %w", base, err))
+				}
+				indexed = true
+			}
+			problems = checkDiff(e, indexGit)
+		}
+		if len(problems) == 0 {
+			fmt.Printf("%v applies on %v: %v\n", e.ID, target, strings.SplitN(e.Message, "\n", 2)[0])
+			continue
+		}
+		conflicts++
+		color.Error.Println(fmt.Sprintf("%v would fail on %v: %v", e.ID, target, strings.SplitN(e.Message, "\n", 2)[0]))
+		for _, p := range problems {
+			fmt.Println("    " + p)
+		}
+	}
+
+	return conflicts, nil
+}
+
+// Apply the diff of the entry to the temporary index, returning the paths it conflicts on
+func checkDiff(e *Entry, indexGit func(args ...string) *exec.Cmd) []string {
+	diffFile, err := filepath.Abs(e.diffFile())
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if _, err := os.Stat(diffFile); err != nil {
+		return []string{"its diff is missing: " + diffFile}
+	}
+	_, err = indexGit("apply", "--cached", diffFile).Output()
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return []string{err.Error()}
+	}
+
+	return conflictPaths(string(exitErr.Stderr))
+}
+
+// Paths git apply complains about, or its messages when there is no path in them
+func conflictPaths(stderr string) []string {
+	paths := []string{}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		line = strings.TrimPrefix(line, "error: ")
+		var path string
+		switch {
+		case strings.HasPrefix(line, "patch failed: "):
+			// patch failed: <path>:<line>
+			path = strings.TrimPrefix(line, "patch failed: ")
+			if i := strings.LastIndex(path, ":"); i != -1 {
+				path = path[:i]
+			}
+		case strings.Contains(line, ": "):
+			// <path>: patch does not apply, already exists in index, does not exist in index...
+			path = line[:strings.Index(line, ": ")]
+		default:
+			path = line
+		}
+		if path != "" && !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// Whether the remote would accept the push of the entry, tip being where the remote branch is
+func checkPush(e *Entry, tip string) []string {
+	if e.ForceWithLease {
+		if tip != e.Lease {
+			return []string{fmt.Sprintf("someone pushed to %v since the push was planned, it won't be overwritten", e.Upstream)}
+		}
+		return nil
+	}
+	if tip == "" {
+		return nil
+	}
+	sha := e.pushRef()
+	if e.Commit == "" {
+		out, err := exec.Command("git", "rev-parse", "--verify", "--quiet", "refs/heads/"+e.Branch).Output()
+		if err != nil {
+			return []string{e.Branch + " doesn't exist anymore"}
+		}
+		sha = strings.TrimSpace(string(out))
+	}
+	if shadowGit("merge-base", "--is-ancestor", tip, sha).Run() != nil {
+		return []string{fmt.Sprintf("%v/%v has commits %v doesn't have, the push would be rejected", e.Remote, e.Upstream, e.Branch)}
+	}
+
+	return nil
+}
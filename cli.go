@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Version of gitplan, overridden at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// Exit codes, so scripts can tell what went wrong without parsing the output
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+	exitGit     = 3
+	exitAuth    = 4
+)
+
+// An error that knows which exit code the process should end with
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// Error for a bad invocation: unknown command, missing or invalid flag
+func usageErrorf(format string, a ...interface{}) error {
+	return &exitError{code: exitUsage, err: fmt.Errorf(format, a...)}
+}
+
+// Wrap an error coming from git (opening, committing, fetching, pushing...)
+func gitError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &exitError{code: exitGit, err: err}
+}
+
+// Wrap an error coming from authentication (key file, passphrase...)
+func authError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &exitError{code: exitAuth, err: err}
+}
+
+// Wrap an error coming from a remote, telling authentication failures apart from other git errors
+func remoteError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, transport.ErrAuthenticationRequired) ||
+		errors.Is(err, transport.ErrAuthorizationFailed) ||
+		strings.Contains(err.Error(), "unable to authenticate") {
+		return authError(err)
+	}
+
+	return gitError(err)
+}
+
+// Exit code matching the given error
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+
+	return exitFailure
+}
+
+// A gitplan subcommand
+// setup registers the flags of the command and returns the function running it with the positional arguments
+type command struct {
+	name    string
+	args    string // positional arguments shown in the usage line, empty if the command takes none
+	summary string
+	setup   func(fs *flag.FlagSet) func(args []string) error
+}
+
+// Parse the flags of the command and run it
+func runCommand(cmd *command, args []string) error {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() {}
+	run := cmd.setup(fs)
+
+	// Flags can come after the arguments, like with git, until --
+	positional := []string{}
+	for {
+		err := fs.Parse(args)
+		if errors.Is(err, flag.ErrHelp) {
+			printCommandUsage(os.Stdout, cmd, fs)
+			return nil
+		}
+		if err != nil {
+			return usageErrorf("%v\nRun 'gitplan %v --help' for usage", err, cmd.name)
+		}
+		if consumed := len(args) - fs.NArg(); consumed > 0 && args[consumed-1] == "--" {
+			positional = append(positional, fs.Args()...)
+			break
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if cmd.args == "" && len(positional) > 0 {
+		return usageErrorf("unexpected argument %q\nRun 'gitplan %v --help' for usage", positional[0], cmd.name)
+	}
+
+	return run(positional)
+}
+
+func printCommandUsage(w io.Writer, cmd *command, fs *flag.FlagSet) {
+	usage := "gitplan " + cmd.name + " [flags]"
+	if cmd.args != "" {
+		usage += " " + cmd.args
+	}
+	fmt.Fprintf(w, "Usage: %v\n\n%v\n", usage, cmd.summary)
+	hasFlags := false
+	fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		fmt.Fprintln(w, "\nFlags:")
+		fs.SetOutput(w)
+		fs.PrintDefaults()
+		fs.SetOutput(io.Discard)
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: gitplan <command> [flags]")
+	fmt.Fprintln(w, "\nPlan your commits now, push them later")
+	fmt.Fprintln(w, "\nCommands:")
+	width := 0
+	for _, cmd := range commands {
+		if len(cmd.name) > width {
+			width = len(cmd.name)
+		}
+	}
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-*v  %v\n", width, cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w, "\nRun 'gitplan <command> --help' for details about a command")
+	fmt.Fprintln(w, "Run 'gitplan --version' to print the version")
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+
+	return nil
+}
+
+// Dispatch the CLI arguments (without the program name) to the right command
+func run(args []string) error {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return usageErrorf("missing command")
+	}
+	useDataDir(locateDataDir())
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		if len(args) > 1 && args[0] == "help" {
+			cmd := findCommand(args[1])
+			if cmd == nil {
+				return usageErrorf("unknown command %q\nRun 'gitplan --help' for usage", args[1])
+			}
+			return runCommand(cmd, []string{"--help"})
+		}
+		printUsage(os.Stdout)
+		return nil
+	case "-version", "--version", "version":
+		fmt.Println("gitplan " + version)
+		return nil
+	case "__complete":
+		// Called by the completion scripts, see completion.go
+		complete(args[1:])
+		return nil
+	case "__hook":
+		// Called by the hooks of the repository, see hooks.go
+		return runHook(args[1:])
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		if strings.HasPrefix(args[0], "-") {
+			return usageErrorf("unknown flag %v\nRun 'gitplan --help' for usage", args[0])
+		}
+		return usageErrorf("unknown command %q\nRun 'gitplan --help' for usage", args[0])
+	}
+
+	return runCommand(cmd, args[1:])
+}
@@ -1,158 +1,490 @@
 package main
 
 import (
-	"bufio"
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
-	"strconv"
+	"path/filepath"
 	"strings"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
 
 	"github.com/gookit/color"
-	"github.com/sony/sonyflake"
 )
 
+// Options of the commit command
+type commitOptions struct {
+	message  string
+	delay    delayFlag
+	remote   string
+	upstream string
+	branch   string
+	all      bool
+	paths    []string
+	amend    string // id of the entry to amend
+	fixup    string // id of the entry to fix up
+}
+
 // Commit changes and prepare files for planned commit
-func Commit() {
-	r, _ := git.PlainOpen(".")
-	customR, err := checkOrCreateGitplanWorkdir(r)
+func Commit(opts *commitOptions) error {
+	if opts.amend != "" || opts.fixup != "" {
+		return Amend(opts)
+	}
+	if opts.message == "" {
+		return usageErrorf("-m is required, you should maybe provide a message for the commit")
+	}
+	if opts.delay.raw == "" {
+		return usageErrorf("-date is required, for example -date +2hours")
+	}
+	r, err := git.PlainOpen(".")
+	if err != nil {
+		return gitError(fmt.Errorf("could not open the git repository: %w", err))
+	}
+	err = refuseStagedDataDir(opts.all || len(opts.paths) > 0)
+	if err != nil {
+		return err
+	}
+	// Everything is checked before committing, so a refused commit leaves the repository as it was
+	currentBranch, err := targetBranch(r, opts.branch)
+	if err != nil {
+		return err
+	}
+	err = checkChanges(opts)
+	if err != nil {
+		return err
+	}
+	remote, upstream, err := branchUpstream(r, currentBranch, opts.remote, opts.upstream)
+	if err != nil {
+		return err
+	}
+	base, err := forkPoint(remote, upstream, "HEAD")
 	if err != nil {
-		color.Error.Println("Something is wrong with .gitplan dir")
-		color.Error.Println(err.Error())
-		panic(err)
+		return err
+	}
+	_, err = checkOrCreateGitplanWorkdir(r, &initOptions{remote: remote})
+	if err != nil {
+		return fmt.Errorf("something is wrong with .gitplan dir: %w", err)
+	}
+	id, err := newEntryID()
+	if err != nil {
+		return err
+	}
+	// What is needed to undo the local commit if the entry can't be written
+	oldHead, indexTree, err := localState()
+	if err != nil {
+		return err
 	}
-	diff, err := commitExistingBranch(r)
 
-	if err != nil || diff == nil {
-		color.Error.Println("Something went wrong committing your changes")
-		panic(err)
+	err = commitExistingBranch(opts)
+	if err != nil {
+		return err
+	}
+	// The local commit exists from here, it is undone whatever fails
+	sha, diff, err := committedDiff()
+	if err == nil {
+		entry := &Entry{
+			ID:       id,
+			Date:     opts.delay.dueDate(),
+			Branch:   currentBranch,
+			Remote:   remote,
+			Upstream: upstream,
+			Base:     base,
+			Message:  opts.message,
+			Commit:   sha,
+			State:    statePending,
+		}
+		err = entry.write(diff)
 	}
-	currentBranch, err := getCurrentBranch(r)
 	if err != nil {
-		color.Error.Println("Could not get current branch name: ")
-		panic(err)
+		rollbackErr := rollbackCommit(oldHead, sha, indexTree)
+		if rollbackErr != nil {
+			return fmt.Errorf("could not plan the commit: %v. The local commit could not be undone either: %w", err, rollbackErr)
+		}
+		return fmt.Errorf("could not plan the commit, the local commit was undone: %w", err)
 	}
 
-	prepareCommitHiddenBranch(customR, diff, currentBranch)
+	return nil
+}
+
+// Check there is something to commit, like git commit would: the staged changes,
+// the changes to tracked files with -a, or the changes to the given paths
+func checkChanges(opts *commitOptions) error {
+	args := []string{"diff", "--quiet", "--staged"}
+	if opts.all || len(opts.paths) > 0 {
+		args = []string{"diff", "--quiet", "HEAD"}
+	}
+	err := exec.Command("git", append(append(args, "--"), opts.paths...)...).Run()
+	if err == nil {
+		if opts.all || len(opts.paths) > 0 {
+			return errors.New("nothing to commit, there are no changes to tracked files there")
+		}
+		return errors.New("nothing to commit, make sure to git add your modifications")
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		return gitError(fmt.Errorf("could not look for changes: %w", err))
+	}
+
+	return nil
 }
 
 // Commit to the existing branch to let the user do other things
-func commitExistingBranch(r *git.Repository) ([]byte, error) {
-	worktree, _ := r.Worktree()
-	/*
-		Unmodified         StatusCode = ' '
-		Untracked          StatusCode = '?'
-		Modified           StatusCode = 'M'
-		Added              StatusCode = 'A'
-		Deleted            StatusCode = 'D'
-		Renamed            StatusCode = 'R'
-		Copied             StatusCode = 'C'
-		UpdatedButUnmerged StatusCode = 'U'
-	*/
-	status, _ := worktree.Status()
-	hasChanges := false
-	for _, s := range status {
-		if (s.Staging != git.Untracked) && (s.Staging != git.Unmodified) {
-			hasChanges = true
-			break
-		}
-	}
-	if !hasChanges {
-		color.Error.Println("Nothing to commit, make sure to git add your modifications")
-
-		return nil, nil
-	}
-	message := getParam("m")
-	if message == "" {
-		color.Error.Println("Should maybe provide a message for the commit")
-
-		return nil, nil
-	}
-	cmd := exec.Command("git", "diff", "--staged")
-	diff, _ := cmd.Output()
-
-	_, err := worktree.Commit(message, &git.CommitOptions{})
-
-	return diff, err
+// git itself commits, so -a and the paths mean what they mean to git commit
+func commitExistingBranch(opts *commitOptions) error {
+	args := []string{"commit", "--quiet", "-m", opts.message}
+	if opts.all {
+		args = append(args, "--all")
+	}
+	args = append(append(args, "--"), opts.paths...)
+	cmd := exec.Command("git", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return gitError(fmt.Errorf("something went wrong committing your changes: %w: %v", err, strings.TrimSpace(string(out))))
+	}
+
+	return nil
+}
+
+// The commit just made and its diff, so the planned commit has exactly the same changes
+// The sha is returned as soon as it is known, to undo the commit when the diff fails
+func committedDiff() (string, []byte, error) {
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", nil, gitError(fmt.Errorf("could not read the new commit: %w", err))
+	}
+	sha := strings.TrimSpace(string(out))
+	diff, err := exec.Command("git", "diff", sha+"^", sha).Output()
+	if err != nil {
+		return sha, nil, gitError(fmt.Errorf("could not diff the commit: %w", err))
+	}
+
+	return sha, diff, nil
 }
 
-// Save the diff file in .gitplan/commits/{id}.diff
-// Save the info in .gitplan/commits/{id}.info
-// Info file contains the date (as an UNIX timestamp), the branch name and the commit message
-func prepareCommitHiddenBranch(r *git.Repository, diff []byte, branchName string) {
-	flake := sonyflake.NewSonyflake(sonyflake.Settings{})
-	id, _ := flake.NextID()
-	message := getParam("m")
-	date := getParam("date")
+// Commit HEAD is on and tree of the index, to undo a local commit with rollbackCommit
+func localState() (string, string, error) {
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", "", gitError(fmt.Errorf("could not read HEAD: %w", err))
+	}
+	head := strings.TrimSpace(string(out))
+	out, err = exec.Command("git", "write-tree").Output()
+	if err != nil {
+		return "", "", gitError(fmt.Errorf("could not read the index, maybe there are unresolved conflicts: %w", err))
+	}
 
-	date = formatDate(date)
+	return head, strings.TrimSpace(string(out)), nil
+}
 
-	info := date + "\n" + branchName + "\n" + message
-	if _, err := os.Stat(".gitplan/commits"); os.IsNotExist(err) {
-		os.Mkdir(".gitplan/commits", 0755)
+// Undo the local commit, when it could not be planned
+// HEAD goes back to where it was, if it is still on the commit, and the index is restored to the tree it had
+// An empty sha is a commit that could not be read, HEAD then goes back wherever it is
+func rollbackCommit(oldHead string, sha string, indexTree string) error {
+	args := []string{"update-ref", "-m", "gitplan: undo the commit that could not be planned", "HEAD", oldHead}
+	if sha != "" {
+		args = append(args, sha)
+	}
+	err := exec.Command("git", args...).Run()
+	if err != nil {
+		return gitError(fmt.Errorf("could not move HEAD back to %v: %w", oldHead, err))
+	}
+	err = exec.Command("git", "read-tree", indexTree).Run()
+	if err != nil {
+		return gitError(fmt.Errorf("could not restore the index: %w", err))
 	}
-	strId := strconv.FormatUint(id, 10)
-	os.WriteFile(".gitplan/commits/"+strId+".info", []byte(info), 0755) // contains date, branche name and commit message
-	os.WriteFile(".gitplan/commits/"+strId+".diff", diff, 0755)
+
+	return nil
 }
 
-func getCurrentBranch(r *git.Repository) (string, error) {
-	head, err := r.Head()
+// Branch the commit is planned on: the one given with -branch, or the current branch
+// A detached HEAD has no branch to plan on, and an unborn branch has no commit to plan after
+func targetBranch(r *git.Repository, branch string) (string, error) {
+	head, err := r.Storer.Reference(plumbing.HEAD)
 	if err != nil {
-		return "", err
+		return "", gitError(fmt.Errorf("could not read HEAD: %w", err))
+	}
+	if head.Type() == plumbing.SymbolicReference {
+		_, err = r.Reference(head.Target(), false)
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return "", fmt.Errorf("Sir, %v has no commit yet, make and push the first one with git, gitplan can plan the next ones", head.Target().Short())
+		}
+		if err != nil {
+			return "", gitError(err)
+		}
+	}
+	if branch != "" {
+		return branch, nil
+	}
+	if head.Type() != plumbing.SymbolicReference || !head.Target().IsBranch() {
+		return "", usageErrorf("HEAD is detached, tell which branch to push to with -branch")
 	}
 
-	return strings.Replace(string(head.Name()), "refs/heads/", "", 1), nil
+	return head.Target().Short(), nil
+}
+
+// Options of the init command, also used when commit initializes .gitplan
+type initOptions struct {
+	auth            string
+	passphraseStore string
+	dataDir         string
+	remote          string
+}
+
+// Initialize .gitplan for the repository in the current directory
+func Init(opts *initOptions) error {
+	r, err := git.PlainOpen(".")
+	if err != nil {
+		return gitError(fmt.Errorf("could not open the git repository: %w", err))
+	}
+	if opts.dataDir != "" {
+		if !validDataDir(opts.dataDir) {
+			return usageErrorf("unknown data dir %q, expected repo or state", opts.dataDir)
+		}
+		err = setDataDir(opts.dataDir)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = checkOrCreateGitplanWorkdir(r, opts)
+
+	return err
 }
 
 // Verify that the .gitplan/repo is initialized
 // if it's not, initialize it
 // returns the .gitplan/repo repository
-func checkOrCreateGitplanWorkdir(r *git.Repository) (*git.Repository, error) {
-	if _, err := os.Stat(".gitplan/repo"); !os.IsNotExist(err) {
-		newR, err := git.PlainOpen(".gitplan/repo")
+func checkOrCreateGitplanWorkdir(r *git.Repository, opts *initOptions) (*git.Repository, error) {
+	// Repositories initialized by older versions were not excluded yet
+	err := excludeDataDir()
+	if err != nil {
+		return nil, fmt.Errorf("could not exclude %v from git: %w", dataDir, err)
+	}
+	if _, err := os.Stat(repoDir); !os.IsNotExist(err) {
+		newR, err := git.PlainOpen(repoDir)
 
+		if err == nil && opts.remote != "" {
+			return newR, ensureShadowRemote(r, newR, opts.remote)
+		}
 		if err == nil {
 			return newR, nil
 		}
 	}
-	color.Comment.Println("Initializing .gitplan/repo folder with a copy of the repository")
-	remote, _ := r.Remote("origin")
-	originUrl := remote.Config().URLs[0]
+	if opts.auth != "" && !validAuth(opts.auth) {
+		return nil, usageErrorf("unknown auth %q, expected agent, key, http or credential-helper", opts.auth)
+	}
+	if opts.passphraseStore != "" && !validSecretStore(opts.passphraseStore) {
+		return nil, usageErrorf("unknown passphrase store %q, expected keyring, file, prompt or none", opts.passphraseStore)
+	}
+	color.Comment.Println("Initializing " + repoDir + " folder, sharing the objects of the repository")
+	trustOnFirstUse = true
+	remote := opts.remote
+	if remote == "" {
+		remote, err = defaultRemote(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	remoteUrl, _, err := remoteURLs(r, remote)
+	if err != nil {
+		return nil, err
+	}
 
-	err := os.MkdirAll(".gitplan/repo", 0755)
+	err = os.MkdirAll(dataDir, 0755)
 	if err != nil {
-		color.Error.Println("Could not initialize .gitplan/repo folder")
-		panic(err)
+		return nil, fmt.Errorf("could not initialize %v folder: %w", dataDir, err)
+	}
+	config, auth, err := setupAuth(opts, remoteUrl)
+	if err != nil {
+		return nil, err
+	}
+	config.Remote = remote
+	err = config.save()
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing is cloned, but connecting once checks the host key and the credentials while the user is there
+	err = config.shareAuth(remoteUrl, auth)
+	if err != nil {
+		return nil, authError(err)
+	}
+	err = listRemote(remoteUrl)
+	if credentials, ok := auth.(*http.BasicAuth); ok && config.Auth == authCredentialHelper {
+		credentialReport(remoteUrl, credentials, err == nil)
+	}
+	if err != nil {
+		return nil, remoteError(fmt.Errorf("could not reach %v: %w", remoteUrl, err))
+	}
+
+	newR, err := createShadowRepository(r, remote)
+	if err != nil {
+		os.RemoveAll(repoDir)
+		return nil, gitError(fmt.Errorf("could not initialize %v: %w", repoDir, err))
+	}
+
+	return newR, nil
+}
+
+// Create the shadow repository as an empty repository borrowing the objects of the user's repository
+// It is what git clone --shared does, through objects/info/alternates, without copying the local branches
+// that already contain the planned commits: the consumer fetches the branches of the remote itself
+func createShadowRepository(r *git.Repository, remote string) (*git.Repository, error) {
+	out, err := exec.Command("git", "rev-parse", "--git-common-dir").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not find the .git directory: %w", err)
+	}
+	objects, err := filepath.Abs(filepath.Join(strings.TrimSpace(string(out)), "objects"))
+	if err != nil {
+		return nil, err
+	}
+	err = exec.Command("git", "init", "--quiet", repoDir).Run()
+	if err != nil {
+		return nil, err
+	}
+	shadowObjects, err := filepath.Abs(filepath.Join(repoDir, ".git", "objects"))
+	if err != nil {
+		return nil, err
+	}
+	// Relative, so it keeps working when the repository is moved
+	alternate, err := filepath.Rel(shadowObjects, objects)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Join(shadowObjects, "info"), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(shadowObjects, "info", "alternates"), []byte(alternate+"\n"), 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = addShadowRemote(r, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	return git.PlainOpen(repoDir)
+}
+
+// Ask how to authenticate to the remote
+// The ssh-agent is used when there is one holding keys, otherwise the user gives a private key file
+func setupAuth(opts *initOptions, remoteUrl string) (*Config, transport.AuthMethod, error) {
+	if isHTTPURL(remoteUrl) {
+		return setupHTTPAuth(opts, remoteUrl)
+	}
+	if opts.auth == authHTTP || opts.auth == authCredentialHelper {
+		return nil, nil, usageErrorf("-auth %v only works with HTTPS remotes, %v is not one", opts.auth, remoteUrl)
+	}
+	mode := opts.auth
+	if mode == "" {
+		mode = authKey
+		if agentAvailable() {
+			mode = authAgent
+		}
+	}
+	if mode == authAgent {
+		color.Info.Println("Sir, we will use the keys of your ssh-agent")
+		config := &Config{Auth: authAgent, PassphraseStore: storeNone}
+		auth, err := config.authMethod(remoteUrl)
+		if err != nil {
+			return nil, nil, authError(err)
+		}
+		return config, auth, nil
+	}
+
+	question := "Sir, we need the path to your private key file"
+	identityFile := ""
+	if r := resolveSSHRemote(remoteUrl); r != nil {
+		identityFile = r.identityFile()
+	}
+	if identityFile != "" {
+		question += fmt.Sprintf(" (press enter for %v, from your ssh config)", identityFile)
+	}
+	privateKeyFile, err := prompt(question, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if privateKeyFile == "" {
+		privateKeyFile = identityFile
 	}
-	color.Info.Println("Sir, we need the path to your private key file")
-	scanner := bufio.NewScanner(os.Stdin)
-	privateKeyFile := ""
 	password := ""
-	for scanner.Scan() {
-		if len(privateKeyFile) == 0 {
-			privateKeyFile = scanner.Text()
-			color.Info.Println("Thanks you good sir, would you now mind giving the passphrase to this private key file, if there is any? Otherwise just press enter")
-		} else {
-			password = scanner.Text()
-			color.Info.Println("Sir, you are awesome")
-			break
+	encrypted, err := isKeyEncrypted(privateKeyFile)
+	if err != nil {
+		return nil, nil, authError(err)
+	}
+	if encrypted {
+		password, err = prompt("Thanks you good sir, would you now mind giving the passphrase to this private key file?", true)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	user := "git"
+	if r := resolveSSHRemote(remoteUrl); r != nil {
+		user = r.user
+	}
+	auth, err := GenerateAuth(user, privateKeyFile, password)
+	if err != nil {
+		return nil, nil, authError(fmt.Errorf("generate publickeys failed: %w", err))
+	}
+	color.Info.Println("Sir, you are awesome")
+
+	// The passphrase is kept out of the config file, in the keyring when there is one
+	config := &Config{Auth: authKey, PrivateKeyFile: privateKeyFile, PassphraseStore: storeNone}
+	if encrypted {
+		config.PassphraseStore = opts.passphraseStore
+		if config.PassphraseStore == "" || config.PassphraseStore == storeNone {
+			config.PassphraseStore = defaultSecretStore()
+		}
+		err = saveSecret(config.PassphraseStore, "passphrase", password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not store the passphrase in the %v store: %w", config.PassphraseStore, err)
 		}
 	}
-	os.WriteFile(".gitplan/config", []byte(privateKeyFile+"\n"+password), 0644)
 
-	auth, err := GenerateAuth(privateKeyFile, password)
+	return config, auth, nil
+}
+
+// Ask how to authenticate to an HTTPS remote
+// The credential helpers of git are used when there is one configured, otherwise the user gives a username and a token
+func setupHTTPAuth(opts *initOptions, remoteUrl string) (*Config, transport.AuthMethod, error) {
+	if opts.auth == authAgent || opts.auth == authKey {
+		return nil, nil, usageErrorf("-auth %v only works with SSH remotes, %v is not one", opts.auth, remoteUrl)
+	}
+	mode := opts.auth
+	if mode == "" {
+		mode = authHTTP
+		if hasCredentialHelper() {
+			mode = authCredentialHelper
+		}
+	}
+	if mode == authCredentialHelper {
+		color.Info.Println("Sir, we will ask your git credential helper")
+		credentials, err := credentialFill(remoteUrl, true)
+		if err != nil {
+			return nil, nil, authError(err)
+		}
+		return &Config{Auth: authCredentialHelper, PassphraseStore: storeNone}, credentials, nil
+	}
+
+	credentials, err := promptHTTPCredentials(remoteUrl)
 	if err != nil {
-		color.Error.Println("generate publickeys failed", err.Error())
-		return nil, err
+		return nil, nil, authError(err)
 	}
+	color.Info.Println("Sir, you are awesome")
 
-	newR, err := git.PlainClone(".gitplan/repo", false, &git.CloneOptions{
-		URL:      originUrl,
-		Auth:     auth,
-		Progress: os.Stdout,
-	})
+	// The token is kept out of the config file, in the keyring when there is one
+	config := &Config{Auth: authHTTP, Username: credentials.Username, PassphraseStore: opts.passphraseStore}
+	if config.PassphraseStore == "" || config.PassphraseStore == storeNone {
+		config.PassphraseStore = defaultSecretStore()
+	}
+	err = saveSecret(config.PassphraseStore, "token", credentials.Password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not store the token in the %v store: %w", config.PassphraseStore, err)
+	}
 
-	return newR, err
+	return config, credentials, nil
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// The shell scripts only forward the words being completed to "gitplan __complete",
+// so new commands and flags are completed without regenerating the scripts
+var completionScripts = map[string]string{
+	"bash": `# bash completion for gitplan
+_gitplan() {
+    local cur=${COMP_WORDS[COMP_CWORD]}
+    local IFS=$'\n'
+    local candidates=($(gitplan __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null | cut -f1))
+    COMPREPLY=($(compgen -W "${candidates[*]}" -- "$cur"))
+}
+complete -o default -F _gitplan gitplan
+`,
+	"zsh": `#compdef gitplan
+# zsh completion for gitplan
+_gitplan() {
+    local -a candidates
+    local line
+    for line in "${(@f)$(gitplan __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}"; do
+        [[ -z $line ]] && continue
+        candidates+=("${${line%%$'\t'*}//:/\\:}:${line#*$'\t'}")
+    done
+    _describe 'gitplan' candidates
+}
+if [[ $zsh_eval_context[-1] == loadautofunc ]]; then
+    _gitplan "$@"
+else
+    compdef _gitplan gitplan
+fi
+`,
+	"fish": `# fish completion for gitplan
+function __gitplan_complete
+    set -l tokens (commandline -opc) (commandline -ct)
+    gitplan __complete $tokens[2..-1] 2>/dev/null
+end
+complete -c gitplan -f -a '(__gitplan_complete)'
+`,
+}
+
+// Print the completion script of the given shell
+func Completion(shell string) error {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return usageErrorf("unsupported shell %q, expected bash, zsh or fish", shell)
+	}
+	fmt.Print(script)
+
+	return nil
+}
+
+// A completion candidate, printed as "value\tdescription"
+type candidate struct {
+	value       string
+	description string
+}
+
+// Print the candidates for the last word of args, the words before it being the beginning of the command line
+func complete(args []string) {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	for _, c := range completeWords(args[:len(args)-1], args[len(args)-1]) {
+		fmt.Printf("%v\t%v\n", c.value, c.description)
+	}
+}
+
+func completeWords(words []string, current string) []candidate {
+	if len(words) == 0 || words[0] == "help" && len(words) == 1 {
+		candidates := []candidate{}
+		for _, cmd := range commands {
+			candidates = append(candidates, candidate{cmd.name, cmd.summary})
+		}
+		if len(words) == 0 {
+			candidates = append(candidates, candidate{"help", "Show the help of a command"})
+		}
+		return filterCandidates(candidates, current)
+	}
+	cmd := findCommand(words[0])
+	if cmd == nil {
+		return nil
+	}
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	cmd.setup(fs)
+
+	// Value of a flag given as a separate word: -branch <value>
+	if prev := words[len(words)-1]; len(words) > 1 && strings.HasPrefix(prev, "-") && !strings.Contains(prev, "=") {
+		if f := fs.Lookup(strings.TrimLeft(prev, "-")); f != nil && !isBoolFlag(f) {
+			placeholder, _ := flag.UnquoteUsage(f)
+			return filterCandidates(completeValue(placeholder), current)
+		}
+	}
+
+	if strings.HasPrefix(current, "-") {
+		// Value of a flag given in the same word: -branch=<value>
+		if i := strings.Index(current, "="); i != -1 {
+			f := fs.Lookup(strings.TrimLeft(current[:i], "-"))
+			if f == nil {
+				return nil
+			}
+			placeholder, _ := flag.UnquoteUsage(f)
+			candidates := []candidate{}
+			for _, c := range completeValue(placeholder) {
+				candidates = append(candidates, candidate{current[:i+1] + c.value, c.description})
+			}
+			return filterCandidates(candidates, current)
+		}
+		candidates := []candidate{}
+		fs.VisitAll(func(f *flag.Flag) {
+			_, usage := flag.UnquoteUsage(f)
+			candidates = append(candidates, candidate{"-" + f.Name, usage})
+		})
+		return filterCandidates(candidates, current)
+	}
+
+	return filterCandidates(completeValue(cmd.args), current)
+}
+
+// Candidates for a value, guessed from its placeholder in the usage:
+// a branch name, a planned entry id, a remote, or one of several choices separated with |
+func completeValue(placeholder string) []candidate {
+	placeholder = strings.Trim(placeholder, "<>[]. ")
+	switch {
+	case placeholder == "branch":
+		return completeBranches()
+	case placeholder == "id":
+		return completeEntryIDs()
+	case placeholder == "remote":
+		return completeRemotes()
+	case strings.Contains(placeholder, "|"):
+		candidates := []candidate{}
+		for _, choice := range strings.Split(placeholder, "|") {
+			candidates = append(candidates, candidate{choice, ""})
+		}
+		return candidates
+	}
+
+	return nil
+}
+
+func completeBranches() []candidate {
+	r, err := git.PlainOpenWithOptions(".", &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil
+	}
+	branches, err := r.Branches()
+	if err != nil {
+		return nil
+	}
+	candidates := []candidate{}
+	branches.ForEach(func(ref *plumbing.Reference) error {
+		candidates = append(candidates, candidate{ref.Name().Short(), "local branch"})
+		return nil
+	})
+
+	return candidates
+}
+
+func completeRemotes() []candidate {
+	r, err := git.PlainOpenWithOptions(".", &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil
+	}
+	remotes, err := r.Remotes()
+	if err != nil {
+		return nil
+	}
+	candidates := []candidate{}
+	for _, remote := range remotes {
+		candidates = append(candidates, candidate{remote.Config().Name, remote.Config().URLs[0]})
+	}
+
+	return candidates
+}
+
+// The ids of the pending entries, described by their commit message
+func completeEntryIDs() []candidate {
+	entries, _, err := loadEntries()
+	if err != nil {
+		return nil
+	}
+	candidates := []candidate{}
+	for _, e := range entries {
+		// The consumer is done with these, there is nothing left to do on them
+		if e.done() {
+			continue
+		}
+		candidates = append(candidates, candidate{e.ID, e.Message})
+	}
+
+	return candidates
+}
+
+func filterCandidates(candidates []candidate, prefix string) []candidate {
+	filtered := []candidate{}
+	for _, c := range candidates {
+		if strings.HasPrefix(c.value, prefix) {
+			// Descriptions are printed on a single line
+			c.description = strings.SplitN(c.description, "\n", 2)[0]
+			filtered = append(filtered, c)
+		}
+	}
+	sort.SliceStable(filtered, func(i, j int) bool { return filtered[i].value < filtered[j].value })
+
+	return filtered
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+
+	return ok && b.IsBoolFlag()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gookit/color"
+)
+
+// Content of .gitplan/config
+// Secrets are never written in it, they go to the passphrase store
+type Config struct {
+	Auth            string `json:"auth"`
+	PrivateKeyFile  string `json:"private_key_file,omitempty"`
+	Username        string `json:"username,omitempty"`
+	PassphraseStore string `json:"passphrase_store"`
+	Remote          string `json:"remote,omitempty"` // remote the authentication was set up for
+	passphraseCache string // the passphrase once loaded, so the prompt store asks it only once
+}
+
+// Read .gitplan/config, migrating the configs of older versions
+func loadConfig() (*Config, error) {
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read config file: %w", err)
+	}
+	if !strings.HasPrefix(strings.TrimSpace(string(content)), "{") {
+		return migrateConfig(string(content))
+	}
+	config := &Config{}
+	err = json.Unmarshal(content, config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+	if config.PassphraseStore == "" {
+		config.PassphraseStore = storeNone
+	}
+	if config.Auth == "" {
+		config.Auth = authKey
+	}
+
+	return config, nil
+}
+
+// Write .gitplan/config, readable by the user only
+func (c *Config) save() error {
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(configFile, append(content, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+
+	// WriteFile keeps the mode of an existing file
+	return os.Chmod(configFile, 0600)
+}
+
+// Get the passphrase of the private key from where it is stored
+func (c *Config) passphrase() (string, error) {
+	if c.passphraseCache != "" {
+		return c.passphraseCache, nil
+	}
+	passphrase, err := loadSecret(c.PassphraseStore, "passphrase", "Passphrase of "+c.PrivateKeyFile+":")
+	if err != nil {
+		return "", fmt.Errorf("could not get the passphrase from the %v store: %w", c.PassphraseStore, err)
+	}
+	c.passphraseCache = passphrase
+
+	return passphrase, nil
+}
+
+// Older versions wrote the private key file and its passphrase in plaintext, on two lines
+// Move the passphrase to the keyring, or to the encrypted secrets file when there is no keyring
+func migrateConfig(content string) (*Config, error) {
+	lines := strings.SplitN(content, "\n", 2)
+	config := &Config{Auth: authKey, PrivateKeyFile: lines[0], PassphraseStore: storeNone}
+	password := ""
+	if len(lines) == 2 {
+		password = lines[1]
+	}
+	if password != "" {
+		config.PassphraseStore = defaultSecretStore()
+		if config.PassphraseStore == storePrompt {
+			config.PassphraseStore = storeFile
+		}
+		color.Warn.Println(fmt.Sprintf("Your passphrase was stored in plaintext in %v, moving it to the %v store", configFile, config.PassphraseStore))
+		err := saveSecret(config.PassphraseStore, "passphrase", password)
+		if err != nil {
+			return nil, fmt.Errorf("could not migrate the plaintext passphrase of %v: %w", configFile, err)
+		}
+	}
+	err := config.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
@@ -1,200 +1,334 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-git/go-git/v5"
-	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/gookit/color"
 )
 
-var auth *gitssh.PublicKeys
+var auth transport.AuthMethod
 
 // Start the consumer that will walk .gitplan/commits to find commits to push on a given date
-func Consume() {
-	if _, err := os.Stat(".gitplan/commits"); os.IsNotExist(err) {
-		color.Error.Println("Can't consume because there has never been any commit using gitplan")
-		return
+func Consume() error {
+	if _, err := os.Stat(commitsDir); os.IsNotExist(err) {
+		return errors.New("can't consume because there has never been any commit using gitplan")
+	}
+	err := lockConsumer()
+	if err != nil {
+		return err
 	}
-	lockConsumer()
 	defer removeLock()
-	r, err := git.PlainOpen(".gitplan/repo")
+	r, err := git.PlainOpen(repoDir)
 	if err != nil {
-		color.Error.Println("Can't consume")
-		return
+		return gitError(fmt.Errorf("can't consume, %v is not a repository: %w", repoDir, err))
 	}
-	config, err := ioutil.ReadFile(".gitplan/config")
+	config, err := loadConfig()
 	if err != nil {
-		color.Error.Println("Can't read config file")
-		return
+		return err
 	}
-	configContent := string(config)
-	c := strings.Split(configContent, "\n")
-	keyFile := ""
-	password := ""
-	for k, v := range c {
-		if k == 0 {
-			keyFile = v
-		} else {
-			password = v
-		}
+	if config.Remote == "" {
+		config.Remote = "origin"
+	}
+	remote, err := r.Remote(config.Remote)
+	if err != nil {
+		return gitError(fmt.Errorf("could not find the %v remote of %v: %w", config.Remote, repoDir, err))
 	}
-	auth, err = GenerateAuth(keyFile, password)
+	// The passphrase or token is asked once, when the consumer starts
+	auth, err = config.authMethod(remote.Config().URLs[0])
 	if err != nil {
-		color.Error.Println("generate publickeys failed", err.Error())
-		panic(err)
+		return authError(err)
+	}
+	err = config.shareAuth(remote.Config().URLs[0], auth)
+	if err != nil {
+		return authError(err)
+	}
+	err = checkRemote(remote)
+	if err != nil {
+		return err
 	}
 	color.Info.Println("You're all set to sleep and your commit will be pushed while you sleep (hopefully)")
+	resetProcessingEntries()
 	for {
-		files, err := ioutil.ReadDir(".gitplan/commits")
+		entries, _, err := loadEntries()
 		if err != nil {
 			// Should never happen, but who knows
-			color.Error.Println("Weird error")
-			panic(err)
+			return fmt.Errorf("weird error: %w", err)
 		}
-		for _, file := range files {
-			if !strings.Contains(file.Name(), ".info") {
+		for _, entry := range entries {
+			if !shouldProcessEntry(entry) {
 				continue
 			}
-			if !shouldProcessFile(file.Name()) {
+			// The queue was read before the previous entries were pushed, this one may have been amended or dropped since
+			current, loadErr := loadEntry(entry.ID)
+			if loadErr != nil || !shouldProcessEntry(current) {
 				continue
 			}
-			processFile(r, file.Name())
+			err = processEntry(r, current)
+			if err != nil {
+				return err
+			}
 		}
 		time.Sleep(time.Duration(20) * time.Second)
 	}
 }
 
+// Entries left processing were being pushed when a previous consumer stopped, they can be retried
+func resetProcessingEntries() {
+	entries, _, _ := loadEntries()
+	for _, entry := range entries {
+		if entry.State == stateProcessing {
+			entry.State = statePending
+			entry.save()
+		}
+	}
+}
+
 // Create a .lock file to make sure only one consumer is started at a time
-func lockConsumer() {
-	if _, err := os.Stat(".gitplan/consumer.lock"); !os.IsNotExist(err) {
-		color.Error.Println("Consumer is already started. If it's not, then you're screwed")
-		os.Exit(1)
+func lockConsumer() error {
+	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
+		return fmt.Errorf("consumer is already started. If it's not, remove %v", lockFile)
 	}
-	os.WriteFile(".gitplan/consumer.lock", []byte(""), 0755)
+	os.WriteFile(lockFile, []byte(""), 0755)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		removeLock()
-		os.Exit(1)
+		os.Exit(exitFailure)
 	}()
+
+	return nil
 }
 
 // Remove the .lock file
 func removeLock() {
-	if _, err := os.Stat(".gitplan/consumer.lock"); os.IsNotExist(err) {
+	if _, err := os.Stat(lockFile); os.IsNotExist(err) {
 		return
 	}
 
-	os.Remove(".gitplan/consumer.lock")
+	os.Remove(lockFile)
 }
 
-// Check if the given file should be processed based on the date in it and current date
-func shouldProcessFile(filename string) bool {
-	content, err := os.ReadFile(".gitplan/commits/" + filename)
-	if err != nil {
+// Check if the given entry should be processed based on its date, its state and current date
+// A failed entry waits longer after each attempt, so a remote down for a while doesn't use them all
+func shouldProcessEntry(entry *Entry) bool {
+	if entry.done() {
 		return false
 	}
+	due := entry.Date
+	if entry.State == stateFailed && entry.LastAttempt > 0 {
+		due = entry.LastAttempt + int64(entry.Attempts)*int64(retryDelay.Seconds())
+	}
+
+	return time.Now().Unix() > due
+}
 
-	fileContent := string(content)
-	date, _ := strconv.ParseInt(strings.Split(fileContent, "\n")[0], 10, 64)
+// Push the entry, keeping track of its state
+// A pushed entry is removed from the queue, a failed one is kept to be retried until it reaches maxAttempts
+// Only errors that must stop the consumer are returned, like the host key of the remote changing
+func processEntry(repository *git.Repository, entry *Entry) error {
+	entry.State = stateProcessing
+	entry.save()
+
+	var err error
+	if entry.Type == typePush {
+		err = pushBranch(entry)
+	} else {
+		err = pushEntry(repository, entry)
+	}
+	if errors.Is(err, errAlreadyPushed) {
+		// Kept in the queue, so the user sees it was not pushed by gitplan, until drop -done removes it
+		entry.State = statePushed
+		entry.save()
+		Notify(fmt.Sprintf("%v was already pushed, nothing to do", entry.Message), true)
+		return nil
+	}
+	if err != nil {
+		entry.State = stateFailed
+		entry.Attempts++
+		entry.LastAttempt = time.Now().Unix()
+		entry.LastError = err.Error()
+		entry.save()
+		Notify(err.Error(), false)
+		var mismatch *hostKeyMismatchError
+		if errors.As(err, &mismatch) {
+			return authError(err)
+		}
+		return nil
+	}
 
-	now := time.Now().Unix()
+	entry.remove()
+	Notify(fmt.Sprintf("%v is pushed!", entry.Branch), true)
 
-	return now > date
+	return nil
 }
 
 // Apply the diff file
 // Add the updated file from the diff
 // Commit the changes and push
 // Remove the branch to ensure the next commit with the same branch name will work
-// Remove the .info and .diff file that was processed
-func processFile(repository *git.Repository, filename string) {
-	content, err := os.ReadFile(".gitplan/commits/" + filename)
-	if err != nil {
-		return
-	}
-	defer deleteFiles(filename)
-	fileContent := string(content)
-	s := strings.Split(fileContent, "\n")
-	branchName, message := s[1], s[2]
-	err = checkoutBranch(branchName)
+func pushEntry(repository *git.Repository, entry *Entry) error {
+	created, err := checkoutBranch(entry)
 	worktree, _ := repository.Worktree()
 	if err != nil && err.Error() != "worktree contains unstaged changes" {
-		Notify(fmt.Sprintf("Something went wrong switching local branch: %v", err.Error()), false)
-		return
+		return fmt.Errorf("Something went wrong switching local branch: %w", err)
+	}
+	defer cleanBranch(repository)
+	pushed, err := alreadyPushed(entry)
+	if err != nil {
+		return err
+	}
+	if pushed {
+		return errAlreadyPushed
 	}
 
-	diffFilename := strings.Replace(filename, ".info", ".diff", -1)
-	cmd := exec.Command("git", "apply", ".gitplan/commits/"+diffFilename, "--directory=.gitplan/repo/")
-	_, err = cmd.Output()
+	diffFile, err := filepath.Abs(entry.diffFile())
 	if err != nil {
-		Notify("Can't apply diff, maybe you comitted an image or something extra weird, sorry", false)
-		return
+		return err
+	}
+	_, err = shadowGit("apply", diffFile).Output()
+	if err != nil {
+		return errors.New("Can't apply diff, maybe you comitted an image or something extra weird, sorry")
 	}
 
 	err = worktree.AddWithOptions(&git.AddOptions{All: true})
 	if err != nil {
-		Notify(fmt.Sprintf("Can't add your changes: %v", err.Error()), false)
-		return
+		return fmt.Errorf("Can't add your changes: %v", err.Error())
 	}
-	_, err = worktree.Commit(message, &git.CommitOptions{})
+	options := &git.CommitOptions{}
+	if author := entry.authorSignature(); author != nil {
+		// The committer still comes from the git config
+		err = options.Validate(repository)
+		if err != nil {
+			return fmt.Errorf("Something went wrong comitting your changes: %v", err.Error())
+		}
+		options.Author = author
+	}
+	_, err = worktree.Commit(entry.Message, options)
 	if err != nil {
-		Notify(fmt.Sprintf("Something went wrong comitting your changes: %v", err.Error()), false)
-		return
+		return fmt.Errorf("Something went wrong comitting your changes: %v", err.Error())
 	}
 
 	// pushing with go-git seems boring and is not equal to "git push"
 	// I'm done wasting time looking for information about go-git
-	os.Chdir(".gitplan/repo")
+	// The branch of the remote is given explicitly, whatever push.default says
+	_, err = shadowGit("push", entry.Remote, "HEAD:refs/heads/"+entry.Upstream).Output()
+	if err != nil {
+		return fmt.Errorf("Something went wrong pushing your changes: %w", commandError(err))
+	}
+	if created {
+		err = setUpstream(entry.Branch, entry.Remote, entry.Upstream)
+		if err != nil {
+			color.Warn.Println(fmt.Sprintf("Could not make %v track %v/%v: %v", entry.Branch, entry.Remote, entry.Upstream, err))
+		}
+	}
 
-	cmd = exec.Command("git", "push")
-	_, err = cmd.Output()
-	os.Chdir("../..")
+	return nil
+}
+
+// Throw away what is left in the worktree and remove the branch after the entry has been processed
+// It will allow us to recreate a branch from remote in case there is an other commit with the same branch Name
+// If we don't do that, we're heading to big troubles, and we don't want to be in big trouble
+func cleanBranch(repository *git.Repository) {
+	shadowGit("reset", "--hard", "--quiet").Run()
+	shadowGit("clean", "-fd", "--quiet").Run()
+
+	headRef, err := repository.Head()
 	if err != nil {
-		Notify(fmt.Sprintf("Something went wrong pushing your changes: %v", err.Error()), false)
 		return
 	}
-
-	Notify(fmt.Sprintf("%v is pushed!", branchName), true)
-	headRef, _ := repository.Head()
-	// Remove the branch after the commit has been processed
-	// It will allow us to recreate a branch from remote in case there is an other commit with the same branch Name
-	// If we don't do that, we're heading to big troubles, and we don't want to be in big trouble
 	repository.Storer.RemoveReference(headRef.Name())
 }
 
-// Checkout the .gitplan/repo to branchname
-// Fetch remote, checkout remote branch, create a new local branch
-func checkoutBranch(branchName string) error {
+// Checkout the shadow repository to the branch of the entry
+// Fetch the remote, create the local branch from the upstream branch of the remote,
+// or from the fork point of the branch when the upstream branch is not on the remote yet, telling it is created
+func checkoutBranch(entry *Entry) (bool, error) {
 	// Use exec to checkout branch, as when doing it using gitplan, it does weird things, without linking local branch to remote branch
-	os.Chdir(".gitplan/repo")
-	defer os.Chdir("../..")
-	cmd := exec.Command("git", "fetch")
+	cmd := shadowGit("fetch", "--prune", entry.Remote)
 	_, err := cmd.Output()
 	if err != nil {
+		err = commandError(err)
 		color.Error.Println(err.Error())
-		return err
+		return false, err
 	}
-	cmd = exec.Command("git", "checkout", branchName)
+	start := "refs/remotes/" + entry.Remote + "/" + entry.Upstream
+	created := false
+	if shadowGit("rev-parse", "--verify", "--quiet", start).Run() != nil {
+		if entry.Base == "" {
+			return false, fmt.Errorf("%v doesn't exist on %v", entry.Upstream, entry.Remote)
+		}
+		start = entry.Base
+		created = true
+	}
+	cmd = shadowGit("checkout", "--quiet", "--no-track", "-B", entry.Branch, start)
 	_, err = cmd.Output()
 
-	return err
+	return created, commandError(err)
+}
+
+// Prepare a git command running in the shadow repository
+// The host keys are checked against the same known_hosts files as gitplan does, without asking anything,
+// and the token or passphrase from the passphrase store are given through GIT_ASKPASS and SSH_ASKPASS
+func shadowGit(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = repoDir
+	// Nobody is there to answer a prompt, git must fail instead of waiting forever
+	cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND="+gitSSHCommand(), "GIT_TERMINAL_PROMPT=0", hookSkipEnv+"=1")
+	// The secrets are only in the environment of the commands that connect to the remote
+	if len(args) > 0 && (args[0] == "fetch" || args[0] == "push" || args[0] == "ls-remote") {
+		cmd.Env = append(cmd.Env, askpassEnvironment()...)
+	}
+
+	return cmd
 }
 
-func deleteFiles(filename string) {
-	infoFile := ".gitplan/commits/" + filename
-	diffFile := strings.Replace(infoFile, ".info", ".diff", -1)
+// Add what a failed git command printed to its error
+func commandError(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || len(exitErr.Stderr) == 0 {
+		return err
+	}
+	stderr := string(exitErr.Stderr)
+	if strings.Contains(stderr, "REMOTE HOST IDENTIFICATION HAS CHANGED") {
+		return &hostKeyMismatchError{host: "the remote"}
+	}
+
+	return fmt.Errorf("%w: %v", err, strings.TrimSpace(stderr))
+}
+
+// Connect to the remote once to check its host key and the authentication
+// A host key mismatch stops the consumer, other errors (like being offline) are only reported
+func checkRemote(remote *git.Remote) error {
+	err := listRemote(remote.Config().URLs[0])
+	var mismatch *hostKeyMismatchError
+	if errors.As(err, &mismatch) {
+		Notify(mismatch.Error(), false)
+		return authError(mismatch)
+	}
+	if err != nil {
+		color.Warn.Println("Could not reach the remote, will try again when a commit is due: " + err.Error())
+	}
+
+	return nil
+}
+
+// List the branches of the remote URL with git ls-remote, authenticating like the consumer pushes
+func listRemote(remoteURL string) error {
+	cmd := shadowGit("ls-remote", "--heads", remoteURL)
+	// During init the shadow repository doesn't exist yet
+	cmd.Dir = ""
+	_, err := cmd.Output()
 
-	os.Remove(infoFile)
-	os.Remove(diffFile)
+	return commandError(err)
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// Environment of the git commands run by the consumer, when gitplan answers their credential prompts
+// See askpass
+const (
+	askpassEnv         = "GITPLAN_ASKPASS"
+	askpassUsernameEnv = "GITPLAN_ASKPASS_USERNAME"
+	askpassPasswordEnv = "GITPLAN_ASKPASS_PASSWORD"
+	askpassKeyEnv      = "GITPLAN_ASKPASS_PASSPHRASE"
+	askpassHostEnv     = "GITPLAN_ASKPASS_HOST"
+	askpassTrustEnv    = "GITPLAN_ASKPASS_TRUST" // set during init, the user is asked whether to trust an unknown host
+)
+
+// Credentials given to the git commands of the consumer, when they come from the passphrase store,
+// and the host they are for, git asking for another host gets nothing
+var (
+	askpassCredentials *http.BasicAuth
+	askpassHost        string
+)
+
+// Private key given to the ssh commands of the consumer, and its passphrase, with the key auth
+var (
+	sshKeyFile       string
+	sshKeyPassphrase string
+)
+
+func isHTTPURL(remoteURL string) bool {
+	return strings.HasPrefix(remoteURL, "https://") || strings.HasPrefix(remoteURL, "http://")
+}
+
+// Check if git has a credential helper configured
+func hasCredentialHelper() bool {
+	out, err := exec.Command("git", "config", "--get-all", "credential.helper").Output()
+
+	return err == nil && strings.TrimSpace(string(out)) != ""
+}
+
+// Ask the credential helpers of git for the credentials of the URL, with "git credential fill"
+// When interactive is false, git is not allowed to prompt for what the helpers don't know
+func credentialFill(remoteURL string, interactive bool) (*http.BasicAuth, error) {
+	values, err := gitCredential("fill", remoteURL, nil, interactive)
+	if err != nil {
+		return nil, err
+	}
+	if values["password"] == "" {
+		return nil, fmt.Errorf("no credentials found for %v", remoteURL)
+	}
+
+	return &http.BasicAuth{Username: values["username"], Password: values["password"]}, nil
+}
+
+// Tell the credential helpers whether the credentials worked, with "git credential approve" or "git credential reject"
+func credentialReport(remoteURL string, credentials *http.BasicAuth, worked bool) {
+	action := "reject"
+	if worked {
+		action = "approve"
+	}
+	gitCredential(action, remoteURL, credentials, false)
+}
+
+// Run "git credential <action>", see https://git-scm.com/docs/git-credential
+func gitCredential(action string, remoteURL string, credentials *http.BasicAuth, interactive bool) (map[string]string, error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+	input := fmt.Sprintf("protocol=%v\nhost=%v\npath=%v\n", u.Scheme, u.Host, strings.TrimPrefix(u.Path, "/"))
+	if u.User != nil && u.User.Username() != "" {
+		input += "username=" + u.User.Username() + "\n"
+	}
+	if credentials != nil {
+		input += fmt.Sprintf("username=%v\npassword=%v\n", credentials.Username, credentials.Password)
+	}
+	cmd := exec.Command("git", "credential", action)
+	cmd.Stdin = strings.NewReader(input + "\n")
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if !interactive {
+		cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0")
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git credential %v failed: %w", action, err)
+	}
+	values := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		s := strings.SplitN(scanner.Text(), "=", 2)
+		if len(s) == 2 {
+			values[s[0]] = s[1]
+		}
+	}
+
+	return values, nil
+}
+
+// Answer the prompts of git when gitplan is its GIT_ASKPASS, and of ssh when it is its SSH_ASKPASS
+// git gives the prompt, like "Username for 'https://example.com': ", as the only argument,
+// ssh gives "Enter passphrase for key '/home/me/.ssh/id_ed25519': ", or asks whether to trust an unknown host
+// Returns an error, making git fail, when the prompt is for another host than the one of the credentials
+func askpass(args []string) error {
+	question := strings.Join(args, " ")
+	if strings.HasPrefix(strings.ToLower(question), "enter passphrase for") {
+		fmt.Println(os.Getenv(askpassKeyEnv))
+		return nil
+	}
+	if strings.Contains(question, "(yes/no") {
+		if os.Getenv(askpassTrustEnv) == "" {
+			fmt.Println("no")
+			return nil
+		}
+		// What is printed goes to ssh, the question is asked on the terminal
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer tty.Close()
+		fmt.Fprint(tty, question+" ")
+		answer, err := bufio.NewReader(tty).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fmt.Println(strings.TrimSpace(answer))
+		return nil
+	}
+	if start, end := strings.Index(question, "'"), strings.LastIndex(question, "'"); start < end {
+		u, err := url.Parse(question[start+1 : end])
+		if err != nil || u.Host != os.Getenv(askpassHostEnv) {
+			return fmt.Errorf("gitplan has no credentials for %v", question[start+1:end])
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(question), "username") {
+		fmt.Println(os.Getenv(askpassUsernameEnv))
+		return nil
+	}
+	fmt.Println(os.Getenv(askpassPasswordEnv))
+
+	return nil
+}
+
+// Environment making git and ssh ask gitplan for the credentials and the passphrase, see askpass
+func askpassEnvironment() []string {
+	executable, err := os.Executable()
+	if err != nil || askpassCredentials == nil && sshKeyPassphrase == "" {
+		return nil
+	}
+	env := []string{askpassEnv + "=1"}
+	if askpassCredentials != nil {
+		env = append(env,
+			"GIT_ASKPASS="+executable,
+			askpassHostEnv+"="+askpassHost,
+			askpassUsernameEnv+"="+askpassCredentials.Username,
+			askpassPasswordEnv+"="+askpassCredentials.Password,
+		)
+	}
+	if sshKeyPassphrase != "" {
+		// force makes ssh use it without a display, instead of asking on the terminal
+		env = append(env,
+			"SSH_ASKPASS="+executable,
+			"SSH_ASKPASS_REQUIRE=force",
+			askpassKeyEnv+"="+sshKeyPassphrase,
+		)
+		if trustOnFirstUse {
+			env = append(env, askpassTrustEnv+"=1")
+		}
+	}
+
+	return env
+}
+
+// Make the git commands run by gitplan authenticate to remoteURL with auth, built from the config
+// The ssh-agent and the credential helpers are found by git itself
+func (c *Config) shareAuth(remoteURL string, auth transport.AuthMethod) error {
+	switch c.Auth {
+	case authHTTP:
+		if credentials, ok := auth.(*http.BasicAuth); ok {
+			askpassCredentials, askpassHost = credentials, remoteHost(remoteURL)
+		}
+	case authKey:
+		path, err := filepath.Abs(c.PrivateKeyFile)
+		if err != nil {
+			return err
+		}
+		passphrase, err := c.passphrase()
+		if err != nil {
+			return err
+		}
+		sshKeyFile, sshKeyPassphrase = path, passphrase
+	}
+
+	return nil
+}
+
+// Apply the url.<base>.insteadOf rules of the git config to the URL, like git does
+// With push set to true, url.<base>.pushInsteadOf rules are applied instead
+func rewriteURL(remoteURL string, push bool) string {
+	key := "insteadof"
+	if push {
+		key = "pushinsteadof"
+	}
+	out, err := exec.Command("git", "config", "--get-regexp", `^url\..*\.`+key+`$`).Output()
+	if err != nil {
+		return remoteURL
+	}
+	type rule struct {
+		base   string
+		prefix string
+	}
+	rules := []rule{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		s := strings.SplitN(line, " ", 2)
+		if len(s) != 2 {
+			continue
+		}
+		base := strings.TrimSuffix(strings.TrimPrefix(s[0], "url."), "."+key)
+		rules = append(rules, rule{base: base, prefix: s[1]})
+	}
+	// The longest matching prefix wins
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].prefix) > len(rules[j].prefix) })
+	for _, r := range rules {
+		if strings.HasPrefix(remoteURL, r.prefix) {
+			return r.base + strings.TrimPrefix(remoteURL, r.prefix)
+		}
+	}
+
+	return remoteURL
+}
+
+// Ask the user for the username and token used to authenticate to an HTTPS remote
+func promptHTTPCredentials(remoteURL string) (*http.BasicAuth, error) {
+	username := ""
+	if u, err := url.Parse(remoteURL); err == nil && u.User != nil {
+		username = u.User.Username()
+	}
+	var err error
+	if username == "" {
+		username, err = prompt("Sir, we need your username on "+remoteURL, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	token, err := prompt("And your access token (or password), good sir", true)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, errors.New("a token is needed to authenticate to " + remoteURL)
+	}
+
+	return &http.BasicAuth{Username: username, Password: token}, nil
+}
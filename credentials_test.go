@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Run askpass with the prompt, and return what it printed
+func runAskpass(t *testing.T, question string) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = askpass([]string{question})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	return strings.TrimSuffix(string(out), "\n"), err
+}
+
+func TestAskpass(t *testing.T) {
+	t.Setenv(askpassHostEnv, "example.com")
+	t.Setenv(askpassUsernameEnv, "me")
+	t.Setenv(askpassPasswordEnv, "token")
+	t.Setenv(askpassKeyEnv, "passphrase")
+	t.Setenv(askpassTrustEnv, "")
+
+	tests := []struct {
+		question string
+		want     string // what is printed, unused when an error is expected
+		fails    bool
+	}{
+		{"Username for 'https://example.com': ", "me", false},
+		{"Password for 'https://me@example.com': ", "token", false},
+		{"Username for 'https://example.com:8443': ", "", true},
+		{"Password for 'https://me@example.com.evil.org': ", "", true},
+		{"Username for 'https://other.org': ", "", true},
+		{"Password for 'https://me@other.org/example.com': ", "", true},
+		{"Enter passphrase for key '/home/me/.ssh/id_ed25519': ", "passphrase", false},
+		{"Are you sure you want to continue connecting (yes/no/[fingerprint])? ", "no", false},
+	}
+	for _, tt := range tests {
+		got, err := runAskpass(t, tt.question)
+		switch {
+		case tt.fails && err == nil:
+			t.Errorf("askpass(%q) printed %q, expected an error", tt.question, got)
+		case !tt.fails && err != nil:
+			t.Errorf("askpass(%q) failed: %v", tt.question, err)
+		case !tt.fails && got != tt.want:
+			t.Errorf("askpass(%q) printed %q, expected %q", tt.question, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteURL(t *testing.T) {
+	// Rules from the environment only, whatever the git config of the machine says
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	rules := [][2]string{
+		{"url.git@github.com:.insteadOf", "https://github.com/"},
+		{"url.git@work.example.com:.insteadOf", "https://github.com/work/"},
+		{"url.https://mirror.example.com/.insteadOf", "gh:"},
+		{"url.git@push.example.com:.pushInsteadOf", "https://github.com/"},
+	}
+	t.Setenv("GIT_CONFIG_COUNT", strconv.Itoa(len(rules)))
+	for i, rule := range rules {
+		t.Setenv("GIT_CONFIG_KEY_"+strconv.Itoa(i), rule[0])
+		t.Setenv("GIT_CONFIG_VALUE_"+strconv.Itoa(i), rule[1])
+	}
+
+	tests := []struct {
+		url  string
+		push bool
+		want string
+	}{
+		{"https://github.com/me/repo.git", false, "git@github.com:me/repo.git"},
+		{"https://github.com/work/repo.git", false, "git@work.example.com:repo.git"},
+		{"https://github.com/workshop/repo.git", false, "git@github.com:workshop/repo.git"},
+		{"gh:me/repo.git", false, "https://mirror.example.com/me/repo.git"},
+		{"https://gitlab.com/me/repo.git", false, "https://gitlab.com/me/repo.git"},
+		{"https://github.com/me/repo.git", true, "git@push.example.com:me/repo.git"},
+		{"gh:me/repo.git", true, "gh:me/repo.git"},
+	}
+	for _, tt := range tests {
+		if got := rewriteURL(tt.url, tt.push); got != tt.want {
+			t.Errorf("rewriteURL(%q, %v) = %q, expected %q", tt.url, tt.push, got, tt.want)
+		}
+	}
+}
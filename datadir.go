@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Where gitplan keeps its data for the repository, chosen with gitplan init -data-dir
+// and remembered in the gitplan.datadir setting of the git config
+const (
+	dataDirRepo  = "repo"  // .gitplan, in the working tree, excluded in .git/info/exclude
+	dataDirState = "state" // $XDG_STATE_HOME/gitplan/<repository>, out of the working tree
+)
+
+func validDataDir(location string) bool {
+	return location == dataDirRepo || location == dataDirState
+}
+
+// Directory of the data, and the paths in it, see useDataDir
+var (
+	dataDir        = ".gitplan"
+	repoDir        = ".gitplan/repo"
+	commitsDir     = ".gitplan/commits"
+	configFile     = ".gitplan/config"
+	secretsFile    = ".gitplan/secrets.age"
+	knownHostsFile = ".gitplan/known_hosts"
+	lockFile       = ".gitplan/consumer.lock"
+	assetsDir      = ".gitplan/assets"
+)
+
+func useDataDir(dir string) {
+	dataDir = dir
+	repoDir = filepath.Join(dir, "repo")
+	commitsDir = filepath.Join(dir, "commits")
+	configFile = filepath.Join(dir, "config")
+	secretsFile = filepath.Join(dir, "secrets.age")
+	knownHostsFile = filepath.Join(dir, "known_hosts")
+	lockFile = filepath.Join(dir, "consumer.lock")
+	assetsDir = filepath.Join(dir, "assets")
+}
+
+// Find the data directory of the repository in the current directory, from the git config
+func locateDataDir() string {
+	out, _ := exec.Command("git", "config", "--get", "gitplan.datadir").Output()
+	if strings.TrimSpace(string(out)) == dataDirState {
+		return stateDataDir()
+	}
+
+	return ".gitplan"
+}
+
+// $XDG_STATE_HOME/gitplan/<name>-<hash of the path>, the path telling apart repositories with the same name
+func stateDataDir() string {
+	state := os.Getenv("XDG_STATE_HOME")
+	if state == "" {
+		home, _ := os.UserHomeDir()
+		state = filepath.Join(home, ".local", "state")
+	}
+	path := repositoryPath()
+	hash := sha256.Sum256([]byte(path))
+
+	return filepath.Join(state, "gitplan", filepath.Base(path)+"-"+hex.EncodeToString(hash[:])[:12])
+}
+
+// Remember where the data is kept in the git config of the repository and start using it
+// Refuses to move a data directory that is already initialized, the shadow repository would break
+func setDataDir(location string) error {
+	dir := ".gitplan"
+	if location == dataDirState {
+		dir = stateDataDir()
+	}
+	if dir == dataDir {
+		return nil
+	}
+	if _, err := os.Stat(repoDir); err == nil {
+		return fmt.Errorf("gitplan is already initialized in %v, push or drop the planned commits and remove it before moving the data to %v", dataDir, dir)
+	}
+	err := exec.Command("git", "config", "--local", "gitplan.datadir", location).Run()
+	if err != nil {
+		return gitError(fmt.Errorf("could not set gitplan.datadir in the git config: %w", err))
+	}
+	useDataDir(dir)
+
+	return nil
+}
+
+// Add .gitplan/ to .git/info/exclude, so git never shows nor stages it
+func excludeDataDir() error {
+	if filepath.IsAbs(dataDir) {
+		return nil
+	}
+	out, err := exec.Command("git", "rev-parse", "--git-path", "info/exclude").Output()
+	if err != nil {
+		return gitError(fmt.Errorf("could not find .git/info/exclude: %w", err))
+	}
+	exclude := strings.TrimSpace(string(out))
+	content, err := os.ReadFile(exclude)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.Trim(strings.TrimSpace(line), "/") == filepath.ToSlash(dataDir) {
+			return nil
+		}
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	content = append(content, []byte("# Data of gitplan\n/"+filepath.ToSlash(dataDir)+"/\n")...)
+	err = os.MkdirAll(filepath.Dir(exclude), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(exclude, content, 0644)
+
+	return err
+}
+
+// Paths of the data directory that are staged, they must never be committed
+// With worktree set, the changes to the tracked files of the data directory count too, for commit -a
+func stagedDataPaths(worktree bool) ([]string, error) {
+	if filepath.IsAbs(dataDir) {
+		return nil, nil
+	}
+	against := "--staged"
+	if worktree {
+		against = "HEAD"
+	}
+	out, err := exec.Command("git", "diff", against, "--name-only", "--", dataDir).Output()
+	if err != nil {
+		return nil, gitError(fmt.Errorf("could not list the staged files: %w", err))
+	}
+
+	paths := []string{}
+	for _, path := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths, nil
+}
+
+// Refuse to commit when something of the data directory is staged, see stagedDataPaths
+func refuseStagedDataDir(worktree bool) error {
+	staged, err := stagedDataPaths(worktree)
+	if err != nil {
+		return err
+	}
+	if len(staged) > 0 {
+		return fmt.Errorf("Sir, %v is staged, it holds the data of gitplan (maybe your passphrase) and must not be committed. Unstage it with: git rm -r --cached %v", strings.Join(staged, ", "), dataDir)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gookit/color"
+)
+
+// Remove planned entries from the queue, the given ones, or with done set the ones the consumer is done with
+// The local commits stay on their branches, only their planned push is forgotten
+func Drop(ids []string, done bool) error {
+	if len(ids) == 0 && !done {
+		return usageErrorf("expected the ids of the entries to drop, or -done")
+	}
+	dropped := []*Entry{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		entry, err := findEntry(id)
+		if err != nil {
+			return err
+		}
+		if entry.State == stateProcessing {
+			return fmt.Errorf("Sir, %v is being pushed right now, it's too late to drop it", entry.ID)
+		}
+		if !seen[entry.ID] {
+			seen[entry.ID] = true
+			dropped = append(dropped, entry)
+		}
+	}
+	if done {
+		entries, _, err := loadEntries()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.done() && !seen[e.ID] {
+				dropped = append(dropped, e)
+			}
+		}
+	}
+	if len(dropped) == 0 {
+		color.Info.Println("Sir, the consumer is not done with any entry, there is nothing to drop")
+		return nil
+	}
+	for _, e := range dropped {
+		if e.Type == typePush {
+			e.deleteSnapshot()
+		}
+		e.remove()
+		fmt.Printf("%v dropped (%v): %v\n", e.ID, e.State, strings.SplitN(e.Message, "\n", 2)[0])
+	}
+
+	return nil
+}
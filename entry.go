@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States of a planned entry
+const (
+	statePending    = "pending"
+	stateProcessing = "processing"
+	stateFailed     = "failed"
+	statePushed     = "already-pushed" // the remote had the change before it was due, pushed by hand
+)
+
+// Types of entries
+const (
+	typeCommit = "commit" // a diff, committed on top of the remote branch
+	typePush   = "push"   // a push of a local branch as it is
+)
+
+// Alphabet of the ids, Crockford's base32 in lower case: no i, l, o or u to confuse, and in ASCII order so ids sort as text
+const idAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+// Ids are the milliseconds since idEpoch on 8 characters, enough until 2054, then 2 random characters
+// so that gitplan running twice in the same millisecond doesn't give the same id
+var idEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Time of the last id given by this process, the next one is always later so ids planned together keep their order
+var lastIDTime int64
+
+// Number of times the consumer tries to push an entry before leaving it failed
+const maxAttempts = 3
+
+// Time waited after a failed attempt before retrying, multiplied by the number of attempts
+const retryDelay = 5 * time.Minute
+
+// A planned commit or push, stored in .gitplan/commits/{id}.info next to the .diff file of a commit
+type Entry struct {
+	ID             string `json:"-"`
+	Type           string `json:"type,omitempty"`
+	Date           int64  `json:"date"` // UNIX timestamp of when the entry is due
+	Branch         string `json:"branch"`
+	Remote         string `json:"remote"`
+	Upstream       string `json:"upstream,omitempty"` // branch of the remote the entry is pushed to
+	Base           string `json:"base,omitempty"`     // commit the upstream branch is created from when it is not on the remote
+	Message        string `json:"message"`
+	Author         string `json:"author,omitempty"`           // "Name <email>" of the author, when it is not the committer
+	Commit         string `json:"commit,omitempty"`           // SHA of the local commit, or of the snapshotted branch for a push
+	PatchID        string `json:"patch_id,omitempty"`         // git patch-id of the diff, to recognize it once rebased or cherry-picked
+	ForceWithLease bool   `json:"force_with_lease,omitempty"` // for a push, overwrite the remote branch if it is still at Lease
+	Lease          string `json:"lease,omitempty"`            // empty when the remote branch was missing
+	State          string `json:"state"`
+	Attempts       int    `json:"attempts"`
+	LastAttempt    int64  `json:"last_attempt,omitempty"` // UNIX timestamp of the last failed attempt
+	LastError      string `json:"last_error,omitempty"`
+}
+
+// Changes contained in the diff of an entry
+type Diffstat struct {
+	Files      int `json:"files"`
+	Insertions int `json:"insertions"`
+	Deletions  int `json:"deletions"`
+}
+
+// Reserve the id of a new entry, a short one that sorts in the order entries are planned
+func newEntryID() (string, error) {
+	ms := time.Since(idEpoch).Milliseconds()
+	if ms <= lastIDTime {
+		ms = lastIDTime + 1
+	}
+	lastIDTime = ms
+	random := make([]byte, 2)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", fmt.Errorf("could not generate an id: %w", err)
+	}
+	id := make([]byte, 10)
+	for i := 7; i >= 0; i-- {
+		id[i] = idAlphabet[ms%32]
+		ms /= 32
+	}
+	id[8] = idAlphabet[random[0]%32]
+	id[9] = idAlphabet[random[1]%32]
+	if _, err := os.Stat(filepath.Join(commitsDir, string(id)+".info")); err == nil {
+		return newEntryID()
+	}
+
+	return string(id), nil
+}
+
+// Find the entry whose id is or starts with the given prefix
+func findEntry(prefix string) (*Entry, error) {
+	if prefix == "" {
+		return nil, usageErrorf("expected the id of a planned entry")
+	}
+	entries, _, err := loadEntries()
+	if err != nil {
+		return nil, err
+	}
+	found := []*Entry{}
+	for _, e := range entries {
+		if e.ID == prefix {
+			return e, nil
+		}
+		if strings.HasPrefix(e.ID, prefix) {
+			found = append(found, e)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, usageErrorf("Sir, no planned entry has the id %v", prefix)
+	case 1:
+		return found[0], nil
+	}
+	ids := []string{}
+	for _, e := range found {
+		ids = append(ids, e.ID)
+	}
+
+	return nil, usageErrorf("Sir, %v could be %v, give more of the id", prefix, strings.Join(ids, " or "))
+}
+
+func (e *Entry) infoFile() string {
+	return filepath.Join(commitsDir, e.ID+".info")
+}
+
+func (e *Entry) diffFile() string {
+	return filepath.Join(commitsDir, e.ID+".diff")
+}
+
+// Time at which the entry is due
+func (e *Entry) Due() time.Time {
+	return time.Unix(e.Date, 0)
+}
+
+// Write the .info file of the entry
+func (e *Entry) save() error {
+	content, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(e.infoFile(), append(content, '\n'), 0644)
+}
+
+// Write a new entry, with its diff when it has one
+// The .info file is written last, so an entry is never seen without its diff
+func (e *Entry) write(diff []byte) error {
+	err := os.MkdirAll(commitsDir, 0755)
+	if err != nil {
+		return err
+	}
+	if diff != nil {
+		e.PatchID, err = patchID(diff)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(e.diffFile(), diff, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	err = e.save()
+	if err != nil {
+		os.Remove(e.diffFile())
+	}
+
+	return err
+}
+
+// Keep the files of the entry as they are, the returned function writes them back
+func (e *Entry) backup() (func(), error) {
+	info, err := os.ReadFile(e.infoFile())
+	if err != nil {
+		return nil, err
+	}
+	diff, err := os.ReadFile(e.diffFile())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return func() {
+		if diff != nil {
+			writeFileAtomic(e.diffFile(), diff, 0644)
+		}
+		writeFileAtomic(e.infoFile(), info, 0644)
+	}, nil
+}
+
+// Remove the .info and .diff files of the entry
+func (e *Entry) remove() {
+	os.Remove(e.infoFile())
+	os.Remove(e.diffFile())
+}
+
+// Whether the consumer is done with the entry without pushing it: already pushed, or failed too many times
+func (e *Entry) done() bool {
+	return e.State == stateFailed && e.Attempts >= maxAttempts || e.State == statePushed
+}
+
+// Count the files, inserted and deleted lines of the diff file
+func (e *Entry) Diffstat() Diffstat {
+	stat := Diffstat{}
+	content, err := os.ReadFile(e.diffFile())
+	if err != nil {
+		return stat
+	}
+	// The ---/+++ lines of the header of a file are not changes, a deleted line starting with -- is
+	inHunk := false
+	for _, line := range strings.Split(string(content), "\n") {
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			stat.Files++
+			inHunk = false
+		case strings.HasPrefix(line, "@@ "):
+			inHunk = true
+		case !inHunk:
+		case strings.HasPrefix(line, "+"):
+			stat.Insertions++
+		case strings.HasPrefix(line, "-"):
+			stat.Deletions++
+		}
+	}
+
+	return stat
+}
+
+// An entry whose .info file can't be understood
+type entryError struct {
+	ID  string
+	Err error
+}
+
+func (e *entryError) Error() string {
+	return fmt.Sprintf("invalid entry %v: %v", e.ID, e.Err)
+}
+
+func (e *entryError) Unwrap() error {
+	return e.Err
+}
+
+// Read the .info file of the entry with the given id
+func loadEntry(id string) (*Entry, error) {
+	content, err := os.ReadFile(filepath.Join(commitsDir, id+".info"))
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{ID: id}
+	if strings.HasPrefix(strings.TrimSpace(string(content)), "{") {
+		err = json.Unmarshal(content, e)
+		if err != nil {
+			return nil, &entryError{ID: id, Err: err}
+		}
+	} else {
+		// Entries planned by older versions contain the date, the branch name and the commit message on separate lines
+		s := strings.SplitN(string(content), "\n", 3)
+		if len(s) < 3 {
+			return nil, &entryError{ID: id, Err: errors.New("expected a date, a branch and a message")}
+		}
+		e.Date, err = strconv.ParseInt(s[0], 10, 64)
+		if err != nil {
+			return nil, &entryError{ID: id, Err: fmt.Errorf("malformed date %q", s[0])}
+		}
+		e.Branch, e.Message = s[1], s[2]
+	}
+	if e.Remote == "" {
+		e.Remote = "origin"
+	}
+	if e.Type == "" {
+		e.Type = typeCommit
+	}
+	if e.Upstream == "" {
+		e.Upstream = e.Branch
+	}
+	if e.State == "" {
+		e.State = statePending
+	}
+
+	return e, nil
+}
+
+// Read every entry of the queue, in file name order
+// Entries that can't be read are returned as errors next to the valid ones
+func loadEntries() ([]*Entry, []*entryError, error) {
+	files, err := ioutil.ReadDir(commitsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := []*Entry{}
+	invalid := []*entryError{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".info") {
+			continue
+		}
+		e, err := loadEntry(strings.TrimSuffix(file.Name(), ".info"))
+		var invalidEntry *entryError
+		if errors.As(err, &invalidEntry) {
+			invalid = append(invalid, invalidEntry)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, invalid, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNewEntryID(t *testing.T) {
+	commitsDir = t.TempDir()
+	ids := []string{}
+	for i := 0; i < 100; i++ {
+		id, err := newEntryID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != 10 {
+			t.Errorf("id %q is %v characters long, expected 10", id, len(id))
+		}
+		for _, c := range id {
+			if !strings.ContainsRune(idAlphabet, c) {
+				t.Errorf("id %q contains %q, which is not in the alphabet", id, c)
+			}
+		}
+		ids = append(ids, id)
+	}
+	if !sort.StringsAreSorted(ids) {
+		t.Errorf("ids don't sort in the order they were given: %v", ids)
+	}
+}
+
+func TestFindEntry(t *testing.T) {
+	commitsDir = t.TempDir()
+	for _, id := range []string{"01abc00000", "01abd00000", "01abd00001", "02xyz00000"} {
+		err := (&Entry{ID: id, State: statePending}).save()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		prefix string
+		want   string // empty when an error is expected
+	}{
+		{"01abc00000", "01abc00000"},
+		{"01abc", "01abc00000"},
+		{"02", "02xyz00000"},
+		{"01abd00001", "01abd00001"},
+		{"01abd", ""},
+		{"01", ""},
+		{"03", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		e, err := findEntry(tt.prefix)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("findEntry(%q) = %v, expected an error", tt.prefix, e.ID)
+		case tt.want != "" && err != nil:
+			t.Errorf("findEntry(%q) failed: %v", tt.prefix, err)
+		case tt.want != "" && e.ID != tt.want:
+			t.Errorf("findEntry(%q) = %v, expected %v", tt.prefix, e.ID, tt.want)
+		}
+	}
+}
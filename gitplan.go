@@ -1,24 +1,186 @@
 package main
 
 import (
+	"flag"
+	"os"
+
 	"github.com/gookit/color"
 )
 
+var commands = []*command{
+	{
+		name:    "commit",
+		args:    "[-- <pathspec>...]",
+		summary: "Commit the staged changes (or the given paths) locally and plan them to be pushed later",
+		setup: func(fs *flag.FlagSet) func([]string) error {
+			opts := &commitOptions{}
+			fs.StringVar(&opts.message, "m", "", "commit message (required, unless amending)")
+			fs.BoolVar(&opts.all, "a", false, "commit the changes of all tracked files, like git commit -a")
+			fs.BoolVar(&opts.all, "all", false, "same as -a")
+			fs.Var(&opts.delay, "date", "when to push, as a delay from now like +2hours or +30minutes (required, unless amending)")
+			fs.StringVar(&opts.branch, "branch", "", "`branch` the commit is planned on (default the current branch, required when HEAD is detached)")
+			fs.StringVar(&opts.remote, "remote", "", "`remote` to push to (default the remote of the upstream of the branch, or origin)")
+			fs.StringVar(&opts.upstream, "upstream", "", "`branch` of the remote to push to (default the upstream of the branch, or the same name)")
+			fs.StringVar(&opts.amend, "amend", "", "fold the changes into the planned commit with this `id`, -m changes its message and -date its due date")
+			fs.StringVar(&opts.fixup, "fixup", "", "fold the changes into the planned commit with this `id`, keeping its message")
+
+			// check if .gitplan exists, if not, create it and clone the repository in it
+			// commit to the repository, so the user can continue doing its life without worrying about his changes
+			// Retrieve a diff of the commit, and save it in .gitplan/commits
+			return func(args []string) error {
+				opts.paths = args
+				return Commit(opts)
+			}
+		},
+	},
+	{
+		name:    "schedule",
+		args:    "<rev-range>",
+		summary: "Plan commits already made locally to be pushed later, one by one, for example: gitplan schedule origin/main..HEAD -date +2hours",
+		setup: func(fs *flag.FlagSet) func([]string) error {
+			opts := &scheduleOptions{}
+			fs.Var(&opts.delay, "date", "when to push, as a delay from now like +2hours or +30minutes (required)")
+			fs.BoolVar(&opts.spread, "spread", false, "spread the commits evenly until -date instead of pushing them all at once")
+			fs.StringVar(&opts.branch, "branch", "", "`branch` the commits are planned on (default the branch the range ends at, required when it ends at neither a local branch nor HEAD on a branch)")
+			fs.StringVar(&opts.remote, "remote", "", "`remote` to push to (default the remote of the upstream of the branch, or origin)")
+			fs.StringVar(&opts.upstream, "upstream", "", "`branch` of the remote to push to (default the upstream of the branch, or the same name)")
+			return func(args []string) error {
+				if len(args) != 1 {
+					return usageErrorf("expected exactly one revision range, for example origin/main..HEAD")
+				}
+				return Schedule(args[0], opts)
+			}
+		},
+	},
+	{
+		name:    "split",
+		summary: "Commit the staged changes as several commits and plan them over a window of time, for example: gitplan split -by dir -date-window +4hours",
+		setup: func(fs *flag.FlagSet) func([]string) error {
+			opts := &splitOptions{}
+			fs.Var(&opts.window, "date-window", "push the commits one after the other until this delay from now, like +4hours (required)")
+			fs.StringVar(&opts.by, "by", "", "make one commit per `file|dir` instead of asking which files go in each commit")
+			fs.StringVar(&opts.message, "m", "", "message of the commits, a Go text/template with {{.Group}} and {{.Files}}, for example 'Update {{.Group}}' (default ask for each commit)")
+			fs.StringVar(&opts.branch, "branch", "", "`branch` the commits are planned on (default the current branch, required when HEAD is detached)")
+			fs.StringVar(&opts.remote, "remote", "", "`remote` to push to (default the remote of the upstream of the branch, or origin)")
+			fs.StringVar(&opts.upstream, "upstream", "", "`branch` of the remote to push to (default the upstream of the branch, or the same name)")
+			return func([]string) error { return Split(opts) }
+		},
+	},
+	{
+		name:    "push-at",
+		args:    "<branch>",
+		summary: "Plan a push of a local branch as it is, instead of recreating a commit",
+		setup: func(fs *flag.FlagSet) func([]string) error {
+			opts := &pushAtOptions{}
+			fs.Var(&opts.delay, "date", "when to push, as a delay from now like +2hours or +30minutes (required)")
+			fs.BoolVar(&opts.snapshot, "snapshot", false, "push the branch as it is now, instead of as it is when the push is due")
+			fs.BoolVar(&opts.forceWithLease, "force-with-lease", false, "overwrite the remote branch, if it is still where it was when the push was planned")
+			fs.StringVar(&opts.remote, "remote", "", "`remote` to push to (default the remote of the upstream of the branch, or origin)")
+			fs.StringVar(&opts.upstream, "upstream", "", "`branch` of the remote to push to (default the upstream of the branch, or the same name)")
+			return func(args []string) error {
+				if len(args) != 1 {
+					return usageErrorf("expected exactly one branch")
+				}
+				return PushAt(args[0], opts)
+			}
+		},
+	},
+	{
+		name:    "init",
+		summary: "Initialize .gitplan with a copy of the repository, commit does it when needed",
+		setup: func(fs *flag.FlagSet) func([]string) error {
+			opts := &initOptions{}
+			fs.StringVar(&opts.auth, "auth", "", "how to authenticate to the remote: `agent|key|http|credential-helper` (default agent when an ssh-agent holds keys, key otherwise, and for HTTPS remotes credential-helper when git has one, http otherwise)")
+			fs.StringVar(&opts.passphraseStore, "passphrase-store", "", "where to keep the passphrase of the private key or the HTTPS token: `keyring|file|prompt` (default keyring when available, prompt otherwise)")
+			fs.StringVar(&opts.dataDir, "data-dir", "", "where to keep the data of gitplan: `repo|state`, .gitplan in the repository or $XDG_STATE_HOME/gitplan (default repo)")
+			return func([]string) error { return Init(opts) }
+		},
+	},
+	{
+		name:    "consume",
+		summary: "Watch the planned commits and push them when they are due",
+		setup: func(fs *flag.FlagSet) func([]string) error {
+			// walk .gitplan to find if we have commit to push
+			// If we have, checkout the branch, apply git diff, then git commit, git push (to have the wanted date)
+			return func([]string) error { return Consume() }
+		},
+	},
+	{
+		name:    "check",
+		summary: "Fetch and check that the planned commits still apply on the remote branches, before they are due",
+		setup: func(fs *flag.FlagSet) func([]string) error {
+			return func([]string) error { return Check() }
+		},
+	},
+	{
+		name:    "status",
+		summary: "List the commits that are yet to be pushed",
+		setup: func(fs *flag.FlagSet) func([]string) error {
+			opts := &statusOptions{}
+			fs.StringVar(&opts.format, "format", "table", "output `table|json|csv|tsv|markdown`")
+			fs.StringVar(&opts.template, "template", "", "Go text/template executed for each entry, for example '{{.ID}} {{.Branch}}'")
+			fs.StringVar(&opts.branch, "branch", "", "only list the commits planned on this `branch`")
+			fs.Var(&opts.before, "before", "only list the commits due before this time (+2hours, 15:04, 2006-01-02 15:04 or RFC3339)")
+			fs.Var(&opts.after, "after", "only list the commits due after this time (+2hours, 15:04, 2006-01-02 15:04 or RFC3339)")
+			fs.StringVar(&opts.state, "state", "", "only list the commits in this state: `pending|processing|failed|already-pushed`")
+			fs.StringVar(&opts.sort, "sort", "due", "sort the commits by `due|id|branch`")
+			fs.BoolVar(&opts.watch, "watch", false, "keep the table on screen, updated every second and whenever the queue changes")
+			return func([]string) error { return Status(opts) }
+		},
+	},
+	{
+		name:    "drop",
+		args:    "[id...]",
+		summary: "Remove planned commits or pushes from the queue, the local commits stay on their branches",
+		setup: func(fs *flag.FlagSet) func([]string) error {
+			done := fs.Bool("done", false, "drop the entries the consumer is done with: already pushed, or failed too many times")
+			return func(args []string) error { return Drop(args, *done) }
+		},
+	},
+	{
+		name:    "hooks",
+		args:    "install",
+		summary: "Install git hooks warning when a push contains planned commits, and following them through rebases and amends",
+		setup: func(fs *flag.FlagSet) func([]string) error {
+			opts := &hooksOptions{}
+			fs.StringVar(&opts.prePush, "pre-push", "warn", "what to do when a push contains planned commits: `warn|block`")
+			fs.BoolVar(&opts.force, "force", false, "overwrite the hooks that were not installed by gitplan")
+			return func(args []string) error {
+				if len(args) != 1 {
+					return usageErrorf("expected exactly one action: install")
+				}
+				return Hooks(args[0], opts)
+			}
+		},
+	},
+	{
+		name:    "completion",
+		args:    "bash|zsh|fish",
+		summary: "Print the shell completion script, for example: source <(gitplan completion bash)",
+		setup: func(fs *flag.FlagSet) func([]string) error {
+			return func(args []string) error {
+				if len(args) != 1 {
+					return usageErrorf("expected exactly one shell: bash, zsh or fish")
+				}
+				return Completion(args[0])
+			}
+		},
+	},
+}
+
 func main() {
-	command := getCommand()
-	switch command {
-	case "commit":
-		// check if .gitplan exists, if not, create it and clone the repository in it
-		// commit to the repository, so the user can continue doing its life without worrying about his changes
-		// Retrieve a diff of the commit, and save it in .gitplan/commits
-		Commit()
-	case "consume":
-		// walk .gitplan to find if we have commit to push
-		// If we have, checkout the branch, apply git diff, then git commit, git push (to have the wanted date)
-		Consume()
-	case "status":
-		Status()
-	default:
-		color.Error.Println("Unknown command")
+	if os.Getenv(askpassEnv) != "" {
+		// git is asking for credentials on behalf of the consumer
+		err := askpass(os.Args[1:])
+		if err != nil {
+			color.Error.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	err := run(os.Args[1:])
+	if err != nil {
+		color.Error.Println(err.Error())
 	}
+	os.Exit(exitCode(err))
 }
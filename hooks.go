@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+)
+
+// Set when gitplan runs git itself, so the hooks it installed leave it alone
+const hookSkipEnv = "GITPLAN_NO_HOOKS"
+
+// First line of the hooks installed by gitplan, to recognize them
+const hookMarker = "# Installed by gitplan hooks install"
+
+// Options of the hooks command
+type hooksOptions struct {
+	prePush string
+	force   bool
+}
+
+// Install the hooks keeping the queue in line with what is done in the repository
+func Hooks(action string, opts *hooksOptions) error {
+	if action != "install" {
+		return usageErrorf("unknown action %q, expected install", action)
+	}
+	if opts.prePush != "warn" && opts.prePush != "block" {
+		return usageErrorf("unknown pre-push mode %q, expected warn or block", opts.prePush)
+	}
+	out, err := exec.Command("git", "rev-parse", "--git-path", "hooks").Output()
+	if err != nil {
+		return gitError(fmt.Errorf("could not find the hooks directory: %w", err))
+	}
+	dir := strings.TrimSpace(string(out))
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not find the gitplan executable: %w", err)
+	}
+	// A gitplan that was uninstalled or moved doesn't stop git
+	check := fmt.Sprintf("[ -x %v ] || exit 0\n", shellQuote(executable))
+	hooks := map[string]string{
+		"pre-push":     check + fmt.Sprintf("exec %v __hook pre-push %v \"$@\"", shellQuote(executable), opts.prePush),
+		"post-rewrite": check + fmt.Sprintf("exec %v __hook post-rewrite \"$@\"", shellQuote(executable)),
+	}
+	// Nothing is installed if one of the hooks would overwrite one gitplan didn't install
+	for _, name := range []string{"pre-push", "post-rewrite"} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil && !strings.Contains(string(content), hookMarker) && !opts.force {
+			return fmt.Errorf("Sir, %v already exists, add these lines to it or overwrite it with -force:\n%v", filepath.Join(dir, name), hooks[name])
+		}
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"pre-push", "post-rewrite"} {
+		err = writeFileAtomic(filepath.Join(dir, name), []byte("#!/bin/sh\n"+hookMarker+"\n"+hooks[name]+"\n"), 0755)
+		if err != nil {
+			return fmt.Errorf("could not install the %v hook: %w", name, err)
+		}
+		color.Info.Println("Installed " + filepath.Join(dir, name))
+	}
+
+	return nil
+}
+
+// Run a hook installed by gitplan hooks install, git gives what it gives the hooks
+func runHook(args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("expected a hook name")
+	}
+	if os.Getenv(hookSkipEnv) != "" {
+		return nil
+	}
+	switch args[0] {
+	case "pre-push":
+		if len(args) < 2 {
+			return usageErrorf("expected warn or block")
+		}
+		return prePushHook(args[1] == "block", os.Stdin)
+	case "post-rewrite":
+		return postRewriteHook(os.Stdin)
+	}
+
+	return usageErrorf("unknown hook %q", args[0])
+}
+
+// Entries of the queue still to be pushed by the consumer, whose local commit is known
+func plannedCommits() (map[string]*Entry, error) {
+	entries, _, err := loadEntries()
+	if err != nil {
+		return nil, err
+	}
+	planned := map[string]*Entry{}
+	for _, e := range entries {
+		if e.Type == typeCommit && e.Commit != "" && e.State != statePushed {
+			planned[e.Commit] = e
+		}
+	}
+
+	return planned, nil
+}
+
+// Warn, or refuse, when the pushed commits contain commits planned to be pushed later
+// git gives a line per pushed reference: <local ref> <local sha> <remote ref> <remote sha>
+func prePushHook(block bool, stdin io.Reader) error {
+	planned, err := plannedCommits()
+	if err != nil || len(planned) == 0 {
+		return err
+	}
+	found := []*Entry{}
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 || strings.Trim(fields[1], "0") == "" {
+			// A deleted reference pushes nothing
+			continue
+		}
+		args := []string{"rev-list", fields[1], "--not", "--remotes"}
+		if strings.Trim(fields[3], "0") != "" && exec.Command("git", "cat-file", "-e", fields[3]+"^{commit}").Run() == nil {
+			args = []string{"rev-list", fields[1], "^" + fields[3]}
+		}
+		out, err := exec.Command("git", args...).Output()
+		if err != nil {
+			return gitError(fmt.Errorf("could not list the pushed commits: %w", err))
+		}
+		for _, sha := range strings.Fields(string(out)) {
+			if e, ok := planned[sha]; ok {
+				found = append(found, e)
+				delete(planned, sha)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	now := time.Now()
+	color.Warn.Println("Sir, this push contains commits planned with gitplan:")
+	for _, e := range found {
+		fmt.Fprintf(os.Stderr, "  %v %v planned %v: %v\n", e.ID, e.Commit[:7], relativeDate(e.Due(), now), strings.SplitN(e.Message, "\n", 2)[0])
+	}
+	if block {
+		return errors.New("push refused, run git push --no-verify to push them now anyway")
+	}
+	color.Warn.Println("They are pushed now, gitplan will notice it when they are due")
+
+	return nil
+}
+
+// Follow the local commits of the planned entries when git rewrites them, with commit --amend or rebase
+// git gives a line per rewritten commit: <old sha> <new sha>
+func postRewriteHook(stdin io.Reader) error {
+	planned, err := plannedCommits()
+	if err != nil || len(planned) == 0 {
+		return err
+	}
+	// Commits squashed together are folded into the entry planned first
+	folded := map[string]*Entry{}
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		e, ok := planned[fields[0]]
+		if !ok || e.State == stateProcessing {
+			continue
+		}
+		into, ok := folded[fields[1]]
+		if !ok {
+			// Squashing makes git amend the first commit before reporting the rebase, it was already followed
+			into, ok = planned[fields[1]]
+		}
+		if ok && into != e {
+			if lessID(e.ID, into.ID) {
+				e, into = into, e
+			}
+			e.remove()
+			color.Warn.Println(fmt.Sprintf("%v was squashed into %v, it is pushed with it", e.ID, into.ID))
+			e = into
+		}
+		folded[fields[1]] = e
+		err = updateEntryCommit(e, fields[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Plan the new commit instead of the old one: its diff and its message
+func updateEntryCommit(e *Entry, sha string) error {
+	diff, err := exec.Command("git", "diff", sha+"^", sha).Output()
+	if err != nil {
+		return gitError(fmt.Errorf("could not diff %v: %w", sha, err))
+	}
+	out, err := exec.Command("git", "log", "-1", "--format=%B", sha).Output()
+	if err != nil {
+		return gitError(fmt.Errorf("could not read %v: %w", sha, err))
+	}
+	e.Commit = sha
+	e.Message = strings.TrimRight(string(out), "\n")
+
+	return e.write(diff)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/gookit/color"
+)
+
+// Options of the push-at command
+type pushAtOptions struct {
+	delay          delayFlag
+	snapshot       bool
+	forceWithLease bool
+	remote         string
+	upstream       string
+}
+
+// Plan a push of the branch as it is, instead of a recreated commit
+func PushAt(branch string, opts *pushAtOptions) error {
+	if opts.delay.raw == "" {
+		return usageErrorf("-date is required, for example -date +2hours")
+	}
+	r, err := git.PlainOpen(".")
+	if err != nil {
+		return gitError(fmt.Errorf("could not open the git repository: %w", err))
+	}
+	out, err := exec.Command("git", "rev-parse", "--verify", "--quiet", "refs/heads/"+branch).Output()
+	if err != nil {
+		return usageErrorf("unknown branch %q", branch)
+	}
+	sha := strings.TrimSpace(string(out))
+	remote, upstream, err := branchUpstream(r, branch, opts.remote, opts.upstream)
+	if err != nil {
+		return err
+	}
+	_, err = checkOrCreateGitplanWorkdir(r, &initOptions{remote: remote})
+	if err != nil {
+		return fmt.Errorf("something is wrong with .gitplan dir: %w", err)
+	}
+
+	id, err := newEntryID()
+	if err != nil {
+		return err
+	}
+	entry := &Entry{
+		ID:       id,
+		Type:     typePush,
+		Date:     opts.delay.dueDate(),
+		Branch:   branch,
+		Remote:   remote,
+		Upstream: upstream,
+		Message:  "Push of " + branch,
+		State:    statePending,
+	}
+	if opts.forceWithLease {
+		// The remote branch is expected where it was when the push was planned, or still missing if it was
+		out, _ := exec.Command("git", "rev-parse", "--verify", "--quiet", "refs/remotes/"+remote+"/"+upstream).Output()
+		entry.ForceWithLease = true
+		entry.Lease = strings.TrimSpace(string(out))
+	}
+	if opts.snapshot {
+		entry.Commit = sha
+		entry.Message += " at " + sha[:7]
+		// The commit is kept whatever happens to the branch until then, see snapshotBranch
+		err = snapshotBranch(entry)
+		if err != nil {
+			return err
+		}
+	}
+	err = entry.write(nil)
+	if err != nil {
+		entry.deleteSnapshot()
+		return fmt.Errorf("could not plan the push: %w", err)
+	}
+
+	return nil
+}
+
+// Reference of the shadow repository holding what the push entry pushes
+func (e *Entry) pushRef() string {
+	return "refs/gitplan/" + e.ID
+}
+
+// Fetch the local branch of the entry into the shadow repository, under the reference of the entry
+// A snapshot taken at plan time is also kept under that reference in the user's repository: the shadow repository
+// borrows its objects, a gc there would prune the commit once the branch moves on
+func snapshotBranch(entry *Entry) error {
+	if entry.Commit != "" {
+		out, err := exec.Command("git", "update-ref", entry.pushRef(), entry.Commit).CombinedOutput()
+		if err != nil {
+			return gitError(fmt.Errorf("could not snapshot %v: %w: %v", entry.Branch, err, strings.TrimSpace(string(out))))
+		}
+	}
+	_, err := shadowGit("fetch", "--quiet", "--no-tags", repositoryPath(), "+refs/heads/"+entry.Branch+":"+entry.pushRef()).Output()
+	if err != nil {
+		entry.deleteSnapshot()
+		return gitError(fmt.Errorf("could not snapshot %v: %w", entry.Branch, commandError(err)))
+	}
+
+	return nil
+}
+
+// Delete the references holding the snapshot of the push entry, once it is pushed or not planned
+func (e *Entry) deleteSnapshot() {
+	shadowGit("update-ref", "-d", e.pushRef()).Run()
+	if e.Commit != "" {
+		exec.Command("git", "update-ref", "-d", e.pushRef()).Run()
+	}
+}
+
+// Push the branch of a push entry: as it was snapshotted at plan time, or as it is now
+func pushBranch(entry *Entry) error {
+	if entry.Commit == "" {
+		err := snapshotBranch(entry)
+		if err != nil {
+			return err
+		}
+	}
+	args := []string{"push"}
+	if entry.ForceWithLease {
+		args = append(args, "--force-with-lease=refs/heads/"+entry.Upstream+":"+entry.Lease)
+	}
+	args = append(args, entry.Remote, entry.pushRef()+":refs/heads/"+entry.Upstream)
+	_, err := shadowGit(args...).Output()
+	if err != nil {
+		err = commandError(err)
+		if entry.ForceWithLease && strings.Contains(err.Error(), "stale info") {
+			return errors.New("Sir, someone pushed to " + entry.Upstream + " since you planned to push, it was not overwritten")
+		}
+		return fmt.Errorf("Something went wrong pushing your branch: %w", err)
+	}
+	entry.deleteSnapshot()
+	// The push is done, failing now would retry it without its snapshot
+	err = setUpstream(entry.Branch, entry.Remote, entry.Upstream)
+	if err != nil {
+		color.Warn.Println(fmt.Sprintf("Could not make %v track %v/%v: %v", entry.Branch, entry.Remote, entry.Upstream, err))
+	}
+
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// Remote used when nothing tells which one: origin, or the only remote of the repository
+func defaultRemote(r *git.Repository) (string, error) {
+	remotes, err := r.Remotes()
+	if err != nil {
+		return "", gitError(err)
+	}
+	names := []string{}
+	for _, remote := range remotes {
+		if remote.Config().Name == "origin" {
+			return "origin", nil
+		}
+		names = append(names, remote.Config().Name)
+	}
+	if len(names) == 1 {
+		return names[0], nil
+	}
+	if len(names) == 0 {
+		return "", gitError(errors.New("the repository has no remote to push to"))
+	}
+	sort.Strings(names)
+
+	return "", usageErrorf("there is no origin remote, choose one of %v with -remote", strings.Join(names, ", "))
+}
+
+// Remote and branch of the remote the local branch is pushed to
+// They come from the upstream of the branch in the git config (branch.<name>.remote and branch.<name>.merge),
+// unless remote or upstream are given. Without upstream, the branch is pushed to the default remote under its own name
+func branchUpstream(r *git.Repository, branch string, remote string, upstream string) (string, string, error) {
+	cfg, err := r.Config()
+	if err != nil {
+		return "", "", gitError(err)
+	}
+	// A remote of "." means the branch tracks another local branch, which is not something to push to
+	if b, ok := cfg.Branches[branch]; ok && b.Remote != "" && b.Remote != "." && (remote == "" || remote == b.Remote) {
+		remote = b.Remote
+		if upstream == "" {
+			upstream = strings.TrimPrefix(string(b.Merge), "refs/heads/")
+		}
+	}
+	if remote == "" {
+		remote, err = defaultRemote(r)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if _, ok := cfg.Remotes[remote]; !ok {
+		return "", "", usageErrorf("unknown remote %q", remote)
+	}
+	if upstream == "" {
+		upstream = branch
+	}
+
+	return remote, upstream, nil
+}
+
+// URLs git really uses to fetch from and push to the remote, with the url.<base>.insteadOf
+// and url.<base>.pushInsteadOf rules applied since go-git doesn't know about them
+// The push URL is empty when it is the same as the fetch URL
+func remoteURLs(r *git.Repository, name string) (string, string, error) {
+	remote, err := r.Remote(name)
+	if err != nil {
+		return "", "", gitError(fmt.Errorf("could not find the %v remote: %w", name, err))
+	}
+	configured := remote.Config().URLs[0]
+	pushURL := ""
+	if rewritten := rewriteURL(configured, true); rewritten != configured {
+		pushURL = rewritten
+	}
+
+	return rewriteURL(configured, false), pushURL, nil
+}
+
+// Add the remote of the user's repository to the shadow repository, if it doesn't have it yet
+func ensureShadowRemote(r *git.Repository, shadow *git.Repository, name string) error {
+	_, err := shadow.Remote(name)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, git.ErrRemoteNotFound) {
+		return gitError(err)
+	}
+	// The authentication was set up for the host of the configured remote, its token or key must not go elsewhere
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if config.Remote != "" && config.Remote != name {
+		configured, err := shadow.Remote(config.Remote)
+		if err != nil {
+			return gitError(fmt.Errorf("could not find the %v remote of %v: %w", config.Remote, repoDir, err))
+		}
+		fetchURL, _, err := remoteURLs(r, name)
+		if err != nil {
+			return err
+		}
+		host, configuredHost := remoteHost(fetchURL), remoteHost(configured.Config().URLs[0])
+		if host != configuredHost {
+			return fmt.Errorf("Sir, %v is on %v but gitplan was set up to authenticate to %v (the %v remote), it can't push there", name, host, configuredHost, config.Remote)
+		}
+	}
+
+	return addShadowRemote(r, name)
+}
+
+// Host and port a remote URL connects to, after the ssh config for SSH remotes, empty for local repositories
+func remoteHost(remoteURL string) string {
+	if r := resolveSSHRemote(remoteURL); r != nil {
+		return r.address()
+	}
+	if !isHTTPURL(remoteURL) {
+		return ""
+	}
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
+
+func addShadowRemote(r *git.Repository, name string) error {
+	fetchURL, pushURL, err := remoteURLs(r, name)
+	if err != nil {
+		return err
+	}
+	// The git commands of the consumer go through ssh, which reads the ssh config itself
+	err = exec.Command("git", "-C", repoDir, "remote", "add", name, fetchURL).Run()
+	if err != nil {
+		return gitError(fmt.Errorf("could not add the %v remote to %v: %w", name, repoDir, err))
+	}
+	if pushURL != "" {
+		err = exec.Command("git", "-C", repoDir, "config", "remote."+name+".pushurl", pushURL).Run()
+		if err != nil {
+			return gitError(fmt.Errorf("could not set the push URL of the %v remote: %w", name, err))
+		}
+	}
+
+	return nil
+}
+
+// Commit the branch forked from, to create the upstream branch from it on the remote when it doesn't exist there:
+// the merge-base of the commit with the upstream branch, or with the default branch of the remote when the upstream
+// branch is not on the remote yet
+func forkPoint(remote string, upstream string, commit string) (string, error) {
+	ref := "refs/remotes/" + remote + "/" + upstream
+	if exec.Command("git", "rev-parse", "--verify", "--quiet", ref).Run() == nil {
+		// Only needed if the upstream branch is deleted before the entry is pushed
+		out, _ := exec.Command("git", "merge-base", commit, ref).Output()
+		return strings.TrimSpace(string(out)), nil
+	}
+	ref, err := defaultBranchRef(remote)
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command("git", "merge-base", commit, ref).Output()
+	if err != nil {
+		return "", gitError(fmt.Errorf("%v is not on %v yet, and has nothing in common with %v to create it from", upstream, remote, ref))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Remote-tracking reference of the default branch of the remote: the one its HEAD points to, or main or master
+func defaultBranchRef(remote string) (string, error) {
+	out, err := exec.Command("git", "symbolic-ref", "--quiet", "refs/remotes/"+remote+"/HEAD").Output()
+	if err == nil {
+		return strings.TrimSpace(string(out)), nil
+	}
+	for _, name := range []string{"main", "master"} {
+		ref := "refs/remotes/" + remote + "/" + name
+		if exec.Command("git", "rev-parse", "--verify", "--quiet", ref).Run() == nil {
+			return ref, nil
+		}
+	}
+
+	return "", gitError(fmt.Errorf("the default branch of %v is unknown, run git remote set-head %v --auto, or push the branch once", remote, remote))
+}
+
+// Make the local branch track the branch the consumer created on the remote, unless it already tracks something
+// or is not a local branch (planned with -branch)
+func setUpstream(branch string, remote string, upstream string) error {
+	if exec.Command("git", "rev-parse", "--verify", "--quiet", "refs/heads/"+branch).Run() != nil {
+		return nil
+	}
+	if exec.Command("git", "config", "--get", "branch."+branch+".remote").Run() == nil {
+		return nil
+	}
+	err := exec.Command("git", "config", "branch."+branch+".remote", remote).Run()
+	if err != nil {
+		return err
+	}
+
+	return exec.Command("git", "config", "branch."+branch+".merge", "refs/heads/"+upstream).Run()
+}
+
+// The consumer found the change of the entry on the remote, the user pushed it by hand
+var errAlreadyPushed = errors.New("already pushed")
+
+// Patch-id of a diff, the same for every commit making the same change, whatever it is based on
+func patchID(diff []byte) (string, error) {
+	cmd := exec.Command("git", "patch-id", "--stable")
+	cmd.Stdin = bytes.NewReader(diff)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", gitError(fmt.Errorf("could not compute the patch-id: %w", err))
+	}
+
+	return strings.SplitN(string(out), " ", 2)[0], nil
+}
+
+// Whether the remote branch, as fetched in the shadow repository, already has the change of the entry:
+// its local commit, or a commit with the same patch-id since the branch forked, when it was rebased or cherry-picked
+func alreadyPushed(entry *Entry) (bool, error) {
+	ref := "refs/remotes/" + entry.Remote + "/" + entry.Upstream
+	if shadowGit("rev-parse", "--verify", "--quiet", ref).Run() != nil {
+		return false, nil
+	}
+	if entry.Commit != "" && shadowGit("merge-base", "--is-ancestor", entry.Commit, ref).Run() == nil {
+		return true, nil
+	}
+	id := entry.PatchID
+	if id == "" {
+		// Planned by an older version
+		diff, err := os.ReadFile(entry.diffFile())
+		if err != nil {
+			return false, err
+		}
+		id, err = patchID(diff)
+		if err != nil || id == "" {
+			return false, err
+		}
+	}
+	// Without fork point, the recent commits of the branch are enough, the change was pushed after it was planned
+	args := []string{"log", "--no-merges", "--patch", "--max-count=500", ref}
+	if entry.Base != "" {
+		args = append(args, "^"+entry.Base)
+	}
+	log := shadowGit(args...)
+	patchIDs := shadowGit("patch-id", "--stable")
+	patchIDs.Stdin, _ = log.StdoutPipe()
+	err := log.Start()
+	if err != nil {
+		return false, gitError(err)
+	}
+	out, err := patchIDs.Output()
+	log.Wait()
+	if err != nil {
+		return false, gitError(fmt.Errorf("could not compute the patch-ids of %v: %w", ref, err))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.SplitN(line, " ", 2)[0] == id {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Whether the change of the entry is already on the remote, ignoring errors
+func alreadyOnRemote(entry *Entry) bool {
+	pushed, _ := alreadyPushed(entry)
+
+	return pushed
+}
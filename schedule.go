@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Options of the schedule command
+type scheduleOptions struct {
+	delay    delayFlag
+	spread   bool
+	branch   string
+	remote   string
+	upstream string
+}
+
+// Plan commits already made locally, one entry per commit, keeping their message and author
+func Schedule(revRange string, opts *scheduleOptions) error {
+	if opts.delay.raw == "" {
+		return usageErrorf("-date is required, for example -date +2hours")
+	}
+	r, err := git.PlainOpen(".")
+	if err != nil {
+		return gitError(fmt.Errorf("could not open the git repository: %w", err))
+	}
+	end, endBranch, err := rangeEnd(revRange)
+	if err != nil {
+		return err
+	}
+	branch := opts.branch
+	if branch == "" {
+		branch = endBranch
+	}
+	if branch == "" {
+		head, err := exec.Command("git", "rev-parse", "--verify", "--quiet", "HEAD").Output()
+		if err != nil || strings.TrimSpace(string(head)) != end {
+			return usageErrorf("Sir, %v doesn't end at a local branch, tell which branch to push to with -branch", revRange)
+		}
+		branch, err = targetBranch(r, "")
+		if err != nil {
+			return err
+		}
+	}
+	remote, upstream, err := branchUpstream(r, branch, opts.remote, opts.upstream)
+	if err != nil {
+		return err
+	}
+	base, err := forkPoint(remote, upstream, end)
+	if err != nil {
+		return err
+	}
+	commits, err := listCommits(revRange, "refs/remotes/"+remote+"/"+upstream)
+	if err != nil {
+		return err
+	}
+	entries, _, err := loadEntries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		for _, sha := range commits {
+			if e.Commit == sha {
+				return fmt.Errorf("%v is already planned as %v", sha[:7], e.ID)
+			}
+		}
+	}
+	_, err = checkOrCreateGitplanWorkdir(r, &initOptions{remote: remote})
+	if err != nil {
+		return fmt.Errorf("something is wrong with .gitplan dir: %w", err)
+	}
+
+	// The commits are all planned or none is
+	planned := []*Entry{}
+	rollback := func() {
+		for _, e := range planned {
+			e.remove()
+		}
+	}
+	now := time.Now()
+	for i, sha := range commits {
+		diff, err := exec.Command("git", "diff", sha+"^", sha).Output()
+		if err != nil {
+			rollback()
+			return gitError(fmt.Errorf("could not diff %v: %w", sha, err))
+		}
+		out, err := exec.Command("git", "log", "-1", "--format=%an <%ae>%n%B", sha).Output()
+		if err != nil {
+			rollback()
+			return gitError(fmt.Errorf("could not read %v: %w", sha, err))
+		}
+		id, err := newEntryID()
+		if err != nil {
+			rollback()
+			return err
+		}
+		s := strings.SplitN(string(out), "\n", 2)
+		// With --spread, the commits are pushed one after the other until the date, otherwise all at the date
+		due := now.Add(opts.delay.delay)
+		if opts.spread {
+			due = now.Add(opts.delay.delay * time.Duration(i+1) / time.Duration(len(commits)))
+		}
+		entry := &Entry{
+			ID:       id,
+			Date:     due.Unix(),
+			Branch:   branch,
+			Remote:   remote,
+			Upstream: upstream,
+			Base:     base,
+			Message:  strings.TrimRight(s[1], "\n"),
+			Author:   s[0],
+			Commit:   sha,
+			State:    statePending,
+		}
+		err = entry.write(diff)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("could not plan %v, nothing was planned: %w", sha[:7], err)
+		}
+		planned = append(planned, entry)
+		fmt.Printf("%v planned %v: %v\n", sha[:7], relativeDate(due, now), strings.SplitN(entry.Message, "\n", 2)[0])
+	}
+
+	return nil
+}
+
+// Commit the range ends at, and the local branch it is when it is one
+func rangeEnd(revRange string) (string, string, error) {
+	out, err := exec.Command("git", "rev-parse", revRange, "--").Output()
+	if err != nil {
+		return "", "", usageErrorf("invalid revision range %q", revRange)
+	}
+	ends := []string{}
+	for _, line := range strings.Fields(string(out)) {
+		if line != "--" && !strings.HasPrefix(line, "^") {
+			ends = append(ends, line)
+		}
+	}
+	if len(ends) != 1 {
+		return "", "", usageErrorf("Sir, %v must end at a single commit, like origin/main..HEAD", revRange)
+	}
+	// HEAD is given as the branch it points to
+	out, err = exec.Command("git", "rev-parse", "--symbolic-full-name", revRange, "--").Output()
+	if err != nil {
+		return "", "", usageErrorf("invalid revision range %q", revRange)
+	}
+	for _, line := range strings.Fields(string(out)) {
+		if strings.HasPrefix(line, "refs/heads/") {
+			return ends[0], strings.TrimPrefix(line, "refs/heads/"), nil
+		}
+	}
+
+	return ends[0], "", nil
+}
+
+// Commits of the range, oldest first
+// Merges and root commits are refused, their changes can't be replayed as a single diff,
+// and so are commits that are already on the remote branch
+func listCommits(revRange string, remoteRef string) ([]string, error) {
+	out, err := exec.Command("git", "rev-list", "--reverse", "--parents", revRange, "--").Output()
+	if err != nil {
+		return nil, usageErrorf("invalid revision range %q", revRange)
+	}
+	commits := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) == 1:
+			return nil, fmt.Errorf("%v is a root commit, it can't be planned", fields[0][:7])
+		case len(fields) > 2:
+			return nil, fmt.Errorf("%v is a merge, it can't be planned", fields[0][:7])
+		}
+		if exec.Command("git", "merge-base", "--is-ancestor", fields[0], remoteRef).Run() == nil {
+			return nil, fmt.Errorf("%v is already on %v", fields[0][:7], strings.TrimPrefix(remoteRef, "refs/remotes/"))
+		}
+		commits = append(commits, fields[0])
+	}
+	if len(commits) == 0 {
+		return nil, errors.New("no commit to plan in " + revRange)
+	}
+
+	return commits, nil
+}
+
+// Signature of the author of the entry, for commits planned with schedule
+func (e *Entry) authorSignature() *object.Signature {
+	i := strings.LastIndex(e.Author, " <")
+	if i == -1 || !strings.HasSuffix(e.Author, ">") {
+		return nil
+	}
+
+	return &object.Signature{Name: e.Author[:i], Email: e.Author[i+2 : len(e.Author)-1], When: time.Now()}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+	"github.com/godbus/dbus/v5"
+)
+
+// Where the secrets (like the passphrase of the private key) are kept
+const (
+	storeNone    = "none"    // there is no secret to keep
+	storeKeyring = "keyring" // Secret Service keyring, through D-Bus
+	storeFile    = "file"    // .gitplan/secrets.age, encrypted with a password asked when needed
+	storePrompt  = "prompt"  // nowhere, the secret is asked when needed
+)
+
+var errSecretNotFound = errors.New("secret not found")
+
+// Secrets already asked to the user, so they are only asked once per run
+var promptedSecrets = map[string]string{}
+
+// Password of the secrets file, once asked
+var secretsFilePassword string
+
+func validSecretStore(store string) bool {
+	switch store {
+	case storeNone, storeKeyring, storeFile, storePrompt:
+		return true
+	}
+
+	return false
+}
+
+// Keep the secret with the given name in the store
+func saveSecret(store string, name string, value string) error {
+	switch store {
+	case storeNone:
+		return nil
+	case storePrompt:
+		promptedSecrets[name] = value
+		return nil
+	case storeKeyring:
+		k, err := openKeyring()
+		if err != nil {
+			return err
+		}
+		defer k.close()
+		return k.set("gitplan "+name+" for "+repositoryPath(), secretAttributes(name), value)
+	case storeFile:
+		secrets, err := readSecretsFile()
+		if errors.Is(err, os.ErrNotExist) {
+			secrets = map[string]string{}
+		} else if err != nil {
+			return err
+		}
+		secrets[name] = value
+		return writeSecretsFile(secrets)
+	}
+
+	return fmt.Errorf("unknown secret store %q", store)
+}
+
+// Get the secret with the given name from the store
+// question is what is asked to the user when the store is prompt
+func loadSecret(store string, name string, question string) (string, error) {
+	switch store {
+	case storeNone:
+		return "", nil
+	case storePrompt:
+		if value, ok := promptedSecrets[name]; ok {
+			return value, nil
+		}
+		value, err := prompt(question, true)
+		if err != nil {
+			return "", err
+		}
+		promptedSecrets[name] = value
+		return value, nil
+	case storeKeyring:
+		k, err := openKeyring()
+		if err != nil {
+			return "", err
+		}
+		defer k.close()
+		return k.get(secretAttributes(name))
+	case storeFile:
+		secrets, err := readSecretsFile()
+		if err != nil {
+			return "", err
+		}
+		value, ok := secrets[name]
+		if !ok {
+			return "", errSecretNotFound
+		}
+		return value, nil
+	}
+
+	return "", fmt.Errorf("unknown secret store %q", store)
+}
+
+// The store used when none is given: the keyring if there is one running, otherwise prompting
+func defaultSecretStore() string {
+	k, err := openKeyring()
+	if err != nil {
+		return storePrompt
+	}
+	k.close()
+
+	return storeKeyring
+}
+
+// Absolute path of the repository, to tell apart the secrets of several repositories
+func repositoryPath() string {
+	path, err := filepath.Abs(".")
+	if err != nil {
+		return "."
+	}
+
+	return path
+}
+
+func secretAttributes(name string) map[string]string {
+	return map[string]string{
+		"application": "gitplan",
+		"repository":  repositoryPath(),
+		"name":        name,
+	}
+}
+
+// Decrypt .gitplan/secrets.age, asking for its password the first time
+func readSecretsFile() (map[string]string, error) {
+	content, err := os.ReadFile(secretsFile)
+	if err != nil {
+		return nil, err
+	}
+	if secretsFilePassword == "" {
+		secretsFilePassword, err = prompt("Password of "+secretsFile+":", true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	identity, err := age.NewScryptIdentity(secretsFilePassword)
+	if err != nil {
+		return nil, err
+	}
+	r, err := age.Decrypt(bytes.NewReader(content), identity)
+	if err != nil {
+		secretsFilePassword = ""
+		return nil, fmt.Errorf("could not decrypt %v: %w", secretsFile, err)
+	}
+	decrypted, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	secrets := map[string]string{}
+	err = json.Unmarshal(decrypted, &secrets)
+
+	return secrets, err
+}
+
+// Encrypt the secrets in .gitplan/secrets.age, asking for a new password if there is none yet
+func writeSecretsFile(secrets map[string]string) error {
+	if secretsFilePassword == "" {
+		password, err := prompt("Choose a password for "+secretsFile+", it will be asked when gitplan consume starts:", true)
+		if err != nil {
+			return err
+		}
+		confirmation, err := prompt("Type it again:", true)
+		if err != nil {
+			return err
+		}
+		if password == "" || password != confirmation {
+			return errors.New("the passwords are empty or don't match")
+		}
+		secretsFilePassword = password
+	}
+	recipient, err := age.NewScryptRecipient(secretsFilePassword)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	encrypted := &bytes.Buffer{}
+	w, err := age.Encrypt(encrypted, recipient)
+	if err != nil {
+		return err
+	}
+	w.Write(content)
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(secretsFile, encrypted.Bytes(), 0600)
+}
+
+// Client of the freedesktop Secret Service (GNOME Keyring, KWallet...)
+// See https://specifications.freedesktop.org/secret-service/
+type keyring struct {
+	conn    *dbus.Conn
+	session dbus.ObjectPath
+}
+
+const (
+	secretServiceName = "org.freedesktop.secrets"
+	secretServicePath = "/org/freedesktop/secrets"
+	defaultCollection = "/org/freedesktop/secrets/aliases/default"
+)
+
+// A secret as transferred on D-Bus, its signature is (oayays)
+type dbusSecret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+func openKeyring() (*keyring, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("no keyring available: %w", err)
+	}
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	err = conn.Object(secretServiceName, secretServicePath).
+		Call("org.freedesktop.Secret.Service.OpenSession", 0, "plain", dbus.MakeVariant("")).
+		Store(&output, &session)
+	if err != nil {
+		return nil, fmt.Errorf("no keyring available: %w", err)
+	}
+
+	return &keyring{conn: conn, session: session}, nil
+}
+
+func (k *keyring) close() {
+	k.conn.Object(secretServiceName, k.session).Call("org.freedesktop.Secret.Session.Close", 0)
+}
+
+func (k *keyring) get(attributes map[string]string) (string, error) {
+	var unlocked, locked []dbus.ObjectPath
+	err := k.conn.Object(secretServiceName, secretServicePath).
+		Call("org.freedesktop.Secret.Service.SearchItems", 0, attributes).
+		Store(&unlocked, &locked)
+	if err != nil {
+		return "", err
+	}
+	if len(unlocked) == 0 && len(locked) > 0 {
+		err = k.unlock(locked[:1])
+		if err != nil {
+			return "", err
+		}
+		unlocked = locked[:1]
+	}
+	if len(unlocked) == 0 {
+		return "", errSecretNotFound
+	}
+	var secret dbusSecret
+	err = k.conn.Object(secretServiceName, unlocked[0]).
+		Call("org.freedesktop.Secret.Item.GetSecret", 0, k.session).
+		Store(&secret)
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret.Value), nil
+}
+
+func (k *keyring) set(label string, attributes map[string]string, value string) error {
+	err := k.unlock([]dbus.ObjectPath{defaultCollection})
+	if err != nil {
+		return err
+	}
+	properties := map[string]dbus.Variant{
+		"org.freedesktop.Secret.Item.Label":      dbus.MakeVariant(label),
+		"org.freedesktop.Secret.Item.Attributes": dbus.MakeVariant(attributes),
+	}
+	secret := dbusSecret{Session: k.session, Parameters: []byte{}, Value: []byte(value), ContentType: "text/plain"}
+	var item, promptPath dbus.ObjectPath
+	err = k.conn.Object(secretServiceName, defaultCollection).
+		Call("org.freedesktop.Secret.Collection.CreateItem", 0, properties, secret, true).
+		Store(&item, &promptPath)
+	if err != nil {
+		return err
+	}
+
+	return k.prompt(promptPath)
+}
+
+func (k *keyring) unlock(objects []dbus.ObjectPath) error {
+	var unlocked []dbus.ObjectPath
+	var promptPath dbus.ObjectPath
+	err := k.conn.Object(secretServiceName, secretServicePath).
+		Call("org.freedesktop.Secret.Service.Unlock", 0, objects).
+		Store(&unlocked, &promptPath)
+	if err != nil {
+		return err
+	}
+
+	return k.prompt(promptPath)
+}
+
+// Show the prompt of the keyring (to unlock it for example) and wait for the user to answer it
+func (k *keyring) prompt(path dbus.ObjectPath) error {
+	if path == "/" {
+		return nil
+	}
+	options := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(path),
+		dbus.WithMatchInterface("org.freedesktop.Secret.Prompt"),
+		dbus.WithMatchMember("Completed"),
+	}
+	err := k.conn.AddMatchSignal(options...)
+	if err != nil {
+		return err
+	}
+	defer k.conn.RemoveMatchSignal(options...)
+	signals := make(chan *dbus.Signal, 1)
+	k.conn.Signal(signals)
+	defer k.conn.RemoveSignal(signals)
+
+	err = k.conn.Object(secretServiceName, path).Call("org.freedesktop.Secret.Prompt.Prompt", 0, "").Err
+	if err != nil {
+		return err
+	}
+	for signal := range signals {
+		if signal.Path != path || len(signal.Body) == 0 {
+			continue
+		}
+		if dismissed, _ := signal.Body[0].(bool); dismissed {
+			return errors.New("the keyring prompt was dismissed")
+		}
+		return nil
+	}
+
+	return errors.New("lost the connection to the keyring")
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/gookit/color"
+)
+
+// Options of the split command
+type splitOptions struct {
+	window   delayFlag
+	by       string
+	message  string
+	branch   string
+	remote   string
+	upstream string
+}
+
+// Part of the staged changes, committed and planned on its own
+type splitGroup struct {
+	Group   string   // file or directory the group was made from, empty when chosen by hand
+	Files   []string // staged paths of the group
+	message string
+}
+
+// A staged file, with its line counts as git diff --numstat gives them ("-" for binary files)
+type stagedFile struct {
+	path       string
+	insertions string
+	deletions  string
+}
+
+// Commit the staged changes as several commits, one after the other, and plan them over the window
+func Split(opts *splitOptions) error {
+	if opts.window.raw == "" {
+		return usageErrorf("-date-window is required, for example -date-window +4hours")
+	}
+	switch opts.by {
+	case "", "file", "dir":
+	default:
+		return usageErrorf("unknown grouping %q, expected file or dir", opts.by)
+	}
+	var tmpl *template.Template
+	if opts.message != "" {
+		var err error
+		tmpl, err = template.New("message").Parse(opts.message)
+		if err != nil {
+			return usageErrorf("invalid message template: %v", err)
+		}
+	}
+	r, err := git.PlainOpen(".")
+	if err != nil {
+		return gitError(fmt.Errorf("could not open the git repository: %w", err))
+	}
+	err = refuseStagedDataDir(false)
+	if err != nil {
+		return err
+	}
+	branch, err := targetBranch(r, opts.branch)
+	if err != nil {
+		return err
+	}
+	err = checkChanges(&commitOptions{})
+	if err != nil {
+		return err
+	}
+	remote, upstream, err := branchUpstream(r, branch, opts.remote, opts.upstream)
+	if err != nil {
+		return err
+	}
+	base, err := forkPoint(remote, upstream, "HEAD")
+	if err != nil {
+		return err
+	}
+	files, err := listStagedFiles()
+	if err != nil {
+		return err
+	}
+
+	var groups []*splitGroup
+	if opts.by != "" {
+		groups = groupStagedFiles(files, opts.by)
+	} else {
+		groups, err = chooseGroups(files)
+		if err != nil {
+			return err
+		}
+	}
+	for i, g := range groups {
+		if tmpl != nil {
+			var message bytes.Buffer
+			err = tmpl.Execute(&message, g)
+			if err != nil {
+				return usageErrorf("invalid message template: %v", err)
+			}
+			g.message = message.String()
+			continue
+		}
+		g.message, err = prompt(fmt.Sprintf("Sir, what is the message of commit %v/%v (%v)?", i+1, len(groups), strings.Join(g.Files, ", ")), false)
+		if err != nil {
+			return err
+		}
+		if g.message == "" {
+			return usageErrorf("commit %v needs a message", i+1)
+		}
+	}
+
+	_, err = checkOrCreateGitplanWorkdir(r, &initOptions{remote: remote})
+	if err != nil {
+		return fmt.Errorf("something is wrong with .gitplan dir: %w", err)
+	}
+	ids := []string{}
+	for range groups {
+		id, err := newEntryID()
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	oldHead, indexTree, err := localState()
+	if err != nil {
+		return err
+	}
+	commits, err := commitGroups(groups, oldHead)
+	if err != nil {
+		return err
+	}
+
+	// The commits are all planned or none is
+	planned := []*Entry{}
+	now := time.Now()
+	for i, sha := range commits {
+		diff, err := exec.Command("git", "diff", sha+"^", sha).Output()
+		due := now.Add(opts.window.delay * time.Duration(i+1) / time.Duration(len(commits)))
+		entry := &Entry{
+			ID:       ids[i],
+			Date:     due.Unix(),
+			Branch:   branch,
+			Remote:   remote,
+			Upstream: upstream,
+			Base:     base,
+			Message:  groups[i].message,
+			Commit:   sha,
+			State:    statePending,
+		}
+		if err == nil {
+			err = entry.write(diff)
+		}
+		if err != nil {
+			for _, e := range planned {
+				e.remove()
+			}
+			rollbackErr := rollbackCommit(oldHead, commits[len(commits)-1], indexTree)
+			if rollbackErr != nil {
+				return fmt.Errorf("could not plan %v: %v. The local commits could not be undone either: %w", sha[:7], err, rollbackErr)
+			}
+			return fmt.Errorf("could not plan %v, nothing was committed: %w", sha[:7], err)
+		}
+		planned = append(planned, entry)
+		fmt.Printf("%v planned %v: %v\n", sha[:7], relativeDate(due, now), strings.SplitN(entry.Message, "\n", 2)[0])
+	}
+
+	return nil
+}
+
+// Staged files, in path order
+func listStagedFiles() ([]stagedFile, error) {
+	out, err := exec.Command("git", "diff", "--cached", "--numstat", "--no-renames", "-z").Output()
+	if err != nil {
+		return nil, gitError(fmt.Errorf("could not list the staged changes: %w", err))
+	}
+	files := []stagedFile{}
+	for _, record := range strings.Split(string(out), "\x00") {
+		fields := strings.SplitN(record, "\t", 3)
+		if len(fields) == 3 {
+			files = append(files, stagedFile{path: fields[2], insertions: fields[0], deletions: fields[1]})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+
+	return files, nil
+}
+
+// One group per file, or per directory of the files
+func groupStagedFiles(files []stagedFile, by string) []*splitGroup {
+	groups := []*splitGroup{}
+	index := map[string]*splitGroup{}
+	for _, f := range files {
+		name := f.path
+		if by == "dir" {
+			name = path.Dir(f.path)
+		}
+		g, ok := index[name]
+		if !ok {
+			g = &splitGroup{Group: name}
+			index[name] = g
+			groups = append(groups, g)
+		}
+		g.Files = append(g.Files, f.path)
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Group < groups[j].Group })
+
+	return groups
+}
+
+// Ask which files go in each commit, until every file is in one
+func chooseGroups(files []stagedFile) ([]*splitGroup, error) {
+	for i, f := range files {
+		fmt.Printf("%3d  %v (+%v -%v)\n", i+1, f.path, f.insertions, f.deletions)
+	}
+	groups := []*splitGroup{}
+	chosen := map[int]bool{}
+	for len(chosen) < len(files) {
+		answer, err := prompt(fmt.Sprintf("Sir, which files go in commit %v? Numbers like 1,3-5, nothing for all the others", len(groups)+1), false)
+		if err != nil {
+			return nil, err
+		}
+		numbers, err := parseFileNumbers(answer, len(files))
+		if err != nil {
+			color.Warn.Println(err.Error())
+			continue
+		}
+		g := &splitGroup{}
+		for _, n := range numbers {
+			if !chosen[n] {
+				chosen[n] = true
+				g.Files = append(g.Files, files[n-1].path)
+			}
+		}
+		if len(g.Files) == 0 {
+			color.Warn.Println("These files are already in a commit")
+			continue
+		}
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
+
+// Parse a list of file numbers like 1,3-5, an empty answer is all the files
+func parseFileNumbers(answer string, count int) ([]int, error) {
+	numbers := []int{}
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		for n := 1; n <= count; n++ {
+			numbers = append(numbers, n)
+		}
+		return numbers, nil
+	}
+	for _, part := range strings.Split(answer, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		last := first
+		if err == nil && len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || first < 1 || last > count || first > last {
+			return nil, fmt.Errorf("%q is not a file number or a range of them, between 1 and %v", strings.TrimSpace(part), count)
+		}
+		for n := first; n <= last; n++ {
+			numbers = append(numbers, n)
+		}
+	}
+
+	return numbers, nil
+}
+
+// Commit the groups one after the other, with git so the hooks run
+// Each commit is made from a temporary index holding the previous commit and the staged version of the files of
+// the group, so the working tree is left alone. Once all are made, HEAD has the staged changes and nothing is staged
+// Returns the commits, oldest first, or undoes them
+func commitGroups(groups []*splitGroup, head string) ([]string, error) {
+	dir, err := os.MkdirTemp("", "gitplan-split-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	env := append(os.Environ(), "GIT_INDEX_FILE="+filepath.Join(dir, "index"))
+	indexGit := func(stdin []byte, args ...string) ([]byte, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Env = env
+		cmd.Stdin = bytes.NewReader(stdin)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return out, fmt.Errorf("%w: %v", err, strings.TrimSpace(string(out)))
+		}
+		return out, nil
+	}
+	_, err = indexGit(nil, "read-tree", head)
+	if err != nil {
+		return nil, gitError(fmt.Errorf("could not prepare the commits: %w", err))
+	}
+
+	commits := []string{}
+	for i, g := range groups {
+		// Index entries of the files of the group, as staged, deleted files are removed with a zero mode
+		args := append([]string{"--literal-pathspecs", "ls-files", "--stage", "-z", "--"}, g.Files...)
+		out, err := exec.Command("git", args...).Output()
+		if err == nil {
+			info := string(out)
+			for _, file := range g.Files {
+				if !strings.Contains(info, "\t"+file+"\x00") {
+					info += "0 " + strings.Repeat("0", len(head)) + "\t" + file + "\x00"
+				}
+			}
+			_, err = indexGit([]byte(info), "update-index", "-z", "--index-info")
+		}
+		if err == nil {
+			_, err = indexGit(nil, "commit", "--quiet", "-m", g.message)
+		}
+		if err == nil {
+			out, err = exec.Command("git", "rev-parse", "HEAD").Output()
+		}
+		if err != nil {
+			if len(commits) > 0 {
+				exec.Command("git", "update-ref", "HEAD", head, commits[len(commits)-1]).Run()
+			}
+			return nil, gitError(fmt.Errorf("something went wrong committing %v/%v, nothing was committed: %w", i+1, len(groups), err))
+		}
+		commits = append(commits, strings.TrimSpace(string(out)))
+	}
+
+	return commits, nil
+}
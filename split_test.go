@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFileNumbers(t *testing.T) {
+	tests := []struct {
+		answer string
+		want   []int // nil when an error is expected
+	}{
+		{"", []int{1, 2, 3, 4, 5}},
+		{"  ", []int{1, 2, 3, 4, 5}},
+		{"2", []int{2}},
+		{"1,3", []int{1, 3}},
+		{"2-4", []int{2, 3, 4}},
+		{"1, 3-5", []int{1, 3, 4, 5}},
+		{"4-4", []int{4}},
+		{"0", nil},
+		{"6", nil},
+		{"4-6", nil},
+		{"4-2", nil},
+		{"-1", nil},
+		{"1,", nil},
+		{"two", nil},
+		{"1-2-3", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseFileNumbers(tt.answer, 5)
+		switch {
+		case tt.want == nil && err == nil:
+			t.Errorf("parseFileNumbers(%q) = %v, expected an error", tt.answer, got)
+		case tt.want != nil && err != nil:
+			t.Errorf("parseFileNumbers(%q) failed: %v", tt.answer, err)
+		case tt.want != nil && !reflect.DeepEqual(got, tt.want):
+			t.Errorf("parseFileNumbers(%q) = %v, expected %v", tt.answer, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// An SSH remote, resolved through ~/.ssh/config like OpenSSH does
+type sshRemote struct {
+	alias         string // host as written in the remote URL
+	hostName      string
+	port          string
+	user          string
+	path          string
+	identityFiles []string
+}
+
+var scpLikeURL = regexp.MustCompile(`^(?:([^@/]+)@)?([^:/\s]+):(.*)$`)
+
+// Resolve the host of an SSH remote URL (ssh://... or scp-like user@host:path) through the ssh config
+// Returns nil for other kinds of URLs
+func resolveSSHRemote(remoteURL string) *sshRemote {
+	var user, host, port, path string
+	switch {
+	case isHTTPURL(remoteURL) || strings.HasPrefix(remoteURL, "file://"):
+		return nil
+	case strings.Contains(remoteURL, "://"):
+		u, err := url.Parse(remoteURL)
+		if err != nil || (u.Scheme != "ssh" && u.Scheme != "git+ssh" && u.Scheme != "ssh+git") {
+			return nil
+		}
+		host, port, path = u.Hostname(), u.Port(), u.Path
+		if u.User != nil {
+			user = u.User.Username()
+		}
+		// Like git, ssh://host/~/repo.git is relative to the home directory
+		if strings.HasPrefix(path, "/~") {
+			path = path[1:]
+		}
+	default:
+		m := scpLikeURL.FindStringSubmatch(remoteURL)
+		if m == nil {
+			return nil
+		}
+		user, host, path = m[1], m[2], m[3]
+	}
+
+	r := resolveSSHHost(host)
+	r.path = path
+	if user != "" {
+		r.user = user
+	}
+	if port != "" {
+		r.port = port
+	}
+
+	return r
+}
+
+// Values of a key of the ssh config for a host alias, the first one is the one ssh uses
+// ~/.ssh/config and /etc/ssh/ssh_config are read, the tests give their own config
+var sshConfigValues = func(alias string, key string) []string {
+	values, err := ssh_config.GetAllStrict(alias, key)
+	if err != nil {
+		return nil
+	}
+
+	return values
+}
+
+// Resolve a host alias through the ssh config
+func resolveSSHHost(alias string) *sshRemote {
+	r := &sshRemote{alias: alias, hostName: alias, port: "22", user: "git"}
+	if hostName := sshConfigValues(alias, "HostName"); len(hostName) > 0 && hostName[0] != "" {
+		r.hostName = strings.ReplaceAll(hostName[0], "%h", alias)
+	}
+	if port := sshConfigValues(alias, "Port"); len(port) > 0 && port[0] != "" {
+		r.port = port[0]
+	}
+	if user := sshConfigValues(alias, "User"); len(user) > 0 && user[0] != "" {
+		r.user = user[0]
+	}
+	for _, file := range sshConfigValues(alias, "IdentityFile") {
+		r.identityFiles = append(r.identityFiles, r.expand(file))
+	}
+
+	return r
+}
+
+// Expand the tokens and the ~ of a value of the ssh config, see TOKENS in ssh_config(5)
+func (r *sshRemote) expand(value string) string {
+	home, _ := os.UserHomeDir()
+	if strings.HasPrefix(value, "~/") {
+		value = filepath.Join(home, value[2:])
+	}
+
+	return strings.NewReplacer("%%", "%", "%d", home, "%h", r.hostName, "%n", r.alias, "%p", r.port, "%r", r.user).Replace(value)
+}
+
+// Host and port the remote is reached at
+func (r *sshRemote) address() string {
+	return net.JoinHostPort(r.hostName, r.port)
+}
+
+// First IdentityFile of the ssh config that exists, to suggest it as the private key file
+func (r *sshRemote) identityFile() string {
+	for _, file := range r.identityFiles {
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+
+	return ""
+}
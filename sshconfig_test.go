@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+func TestResolveSSHRemote(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ssh_config.Decode(strings.NewReader(`Host gh
+  HostName github.com
+  User me
+  Port 2222
+  IdentityFile ~/.ssh/id_gh
+
+Host *.corp
+  HostName %h.example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultValues := sshConfigValues
+	sshConfigValues = func(alias string, key string) []string {
+		values, _ := config.GetAll(alias, key)
+		return values
+	}
+	defer func() { sshConfigValues = defaultValues }()
+
+	tests := []struct {
+		url  string
+		want *sshRemote // nil for URLs that are not SSH
+	}{
+		{"git@github.com:me/repo.git", &sshRemote{alias: "github.com", hostName: "github.com", port: "22", user: "git", path: "me/repo.git"}},
+		{"github.com:me/repo.git", &sshRemote{alias: "github.com", hostName: "github.com", port: "22", user: "git", path: "me/repo.git"}},
+		{"gh:me/repo.git", &sshRemote{alias: "gh", hostName: "github.com", port: "2222", user: "me", path: "me/repo.git", identityFiles: []string{filepath.Join(home, ".ssh", "id_gh")}}},
+		{"other@gh:me/repo.git", &sshRemote{alias: "gh", hostName: "github.com", port: "2222", user: "other", path: "me/repo.git", identityFiles: []string{filepath.Join(home, ".ssh", "id_gh")}}},
+		{"ssh://gh:2200/me/repo.git", &sshRemote{alias: "gh", hostName: "github.com", port: "2200", user: "me", path: "/me/repo.git", identityFiles: []string{filepath.Join(home, ".ssh", "id_gh")}}},
+		{"ssh://git@example.com/~/repo.git", &sshRemote{alias: "example.com", hostName: "example.com", port: "22", user: "git", path: "~/repo.git"}},
+		{"git+ssh://other@example.com/repo.git", &sshRemote{alias: "example.com", hostName: "example.com", port: "22", user: "other", path: "/repo.git"}},
+		{"git.corp:repo.git", &sshRemote{alias: "git.corp", hostName: "git.corp.example.com", port: "22", user: "git", path: "repo.git"}},
+		{"https://github.com/me/repo.git", nil},
+		{"file:///tmp/repo.git", nil},
+		{"/tmp/repo.git", nil},
+		{"ftp://example.com/repo.git", nil},
+	}
+	for _, tt := range tests {
+		got := resolveSSHRemote(tt.url)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("resolveSSHRemote(%q) = %+v, expected %+v", tt.url, got, tt.want)
+		}
+	}
+}
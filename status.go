@@ -1,49 +1,296 @@
 package main
 
 import (
-	"io/ioutil"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/gookit/color"
 	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/jedib0t/go-pretty/v6/text"
 )
 
-func Status() {
-	files, err := ioutil.ReadDir(".gitplan/commits")
-	if err != nil || len(files) == 0 {
-		// Should never happen, but who knows
-		color.Error.Println("I guess you don't have any commit yet huh")
-		return
+// Options of the status command
+type statusOptions struct {
+	format   string
+	template string
+	branch   string
+	before   timeFlag
+	after    timeFlag
+	state    string
+	sort     string
+	watch    bool
+}
+
+// An entry as exposed by status --format and --template
+// The JSON field names are part of the output format, don't rename them
+type statusEntry struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Due      time.Time `json:"due"`
+	DueUnix  int64     `json:"due_unix"`
+	Branch   string    `json:"branch"`
+	Remote   string    `json:"remote"`
+	Upstream string    `json:"upstream"`
+	Message  string    `json:"message"`
+	State    string    `json:"state"`
+	Attempts int       `json:"attempts"`
+	Diffstat Diffstat  `json:"diffstat"`
+}
+
+func newStatusEntry(e *Entry) statusEntry {
+	return statusEntry{
+		ID:       e.ID,
+		Type:     e.Type,
+		Due:      e.Due(),
+		DueUnix:  e.Date,
+		Branch:   e.Branch,
+		Remote:   e.Remote,
+		Upstream: e.Upstream,
+		Message:  e.Message,
+		State:    e.State,
+		Attempts: e.Attempts,
+		Diffstat: e.Diffstat(),
 	}
-	t := table.NewWriter()
-	t.SetOutputMirror(os.Stdout)
-	t.AppendHeader(table.Row{"Date", "Branch", "Message"})
-	for _, file := range files {
-		if !strings.Contains(file.Name(), ".info") {
-			continue
-		}
-		content, err := os.ReadFile(".gitplan/commits/" + file.Name())
+}
+
+var statusColumns = []string{"id", "type", "due", "due_unix", "branch", "remote", "upstream", "message", "state", "attempts", "files", "insertions", "deletions"}
+
+func (e statusEntry) columns() []string {
+	return []string{
+		e.ID,
+		e.Type,
+		e.Due.Format(time.RFC3339),
+		strconv.FormatInt(e.DueUnix, 10),
+		e.Branch,
+		e.Remote,
+		e.Upstream,
+		e.Message,
+		e.State,
+		strconv.Itoa(e.Attempts),
+		strconv.Itoa(e.Diffstat.Files),
+		strconv.Itoa(e.Diffstat.Insertions),
+		strconv.Itoa(e.Diffstat.Deletions),
+	}
+}
+
+func Status(opts *statusOptions) error {
+	var tmpl *template.Template
+	if opts.template != "" {
+		var err error
+		tmpl, err = template.New("status").Parse(opts.template)
 		if err != nil {
-			return
+			return usageErrorf("invalid template: %v", err)
 		}
-		fileContent := string(content)
-		s := strings.Split(fileContent, "\n")
-		date, branchName, message := humanDate(s[0]), s[1], s[2]
+	}
+	switch opts.format {
+	case "table", "json", "csv", "tsv", "markdown":
+	default:
+		return usageErrorf("unknown format %q, expected table, json, csv, tsv or markdown", opts.format)
+	}
+	switch opts.state {
+	case "", statePending, stateProcessing, stateFailed, statePushed:
+	default:
+		return usageErrorf("unknown state %q, expected pending, processing, failed or already-pushed", opts.state)
+	}
+	switch opts.sort {
+	case "due", "id", "branch":
+	default:
+		return usageErrorf("unknown sort %q, expected due, id or branch", opts.sort)
+	}
 
-		t.AppendRow(table.Row{date, branchName, message})
+	if opts.watch {
+		if opts.format != "table" || tmpl != nil {
+			return usageErrorf("-watch only works with the table format")
+		}
+		return watchStatus(opts)
 	}
-	t.Render()
+
+	rows, invalid, err := opts.rows()
+	if err != nil {
+		return err
+	}
+	if opts.format != "table" {
+		for _, err := range invalid {
+			fmt.Fprintln(os.Stderr, color.Warn.Sprint(err.Error()))
+		}
+	}
+
+	if tmpl != nil {
+		for _, row := range rows {
+			err = tmpl.Execute(os.Stdout, row)
+			if err != nil {
+				return err
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+
+	switch opts.format {
+	case "json":
+		return writeStatusJSON(os.Stdout, rows)
+	case "csv":
+		return writeStatusCSV(os.Stdout, rows, ',')
+	case "tsv":
+		return writeStatusCSV(os.Stdout, rows, '\t')
+	case "markdown":
+		writeStatusMarkdown(os.Stdout, rows)
+		return nil
+	}
+
+	if len(rows) == 0 && len(invalid) == 0 {
+		color.Warn.Println("I guess you don't have any commit yet huh")
+		return nil
+	}
+	renderStatusTable(os.Stdout, rows, invalid, time.Now(), false)
+
+	return nil
 }
 
-func humanDate(date string) string {
-	i, err := strconv.ParseInt(date, 10, 64)
+// Load the entries matching the filters, sorted as asked in the CLI
+func (opts *statusOptions) rows() ([]statusEntry, []*entryError, error) {
+	entries, invalid, err := loadEntries()
 	if err != nil {
-		panic(err)
+		return nil, nil, err
+	}
+	rows := []statusEntry{}
+	for _, e := range entries {
+		if opts.matches(e) {
+			rows = append(rows, newStatusEntry(e))
+		}
+	}
+	sortStatusEntries(rows, opts.sort)
+
+	return rows, invalid, nil
+}
+
+// Check if the entry goes through the filters given in the CLI
+func (opts *statusOptions) matches(e *Entry) bool {
+	if opts.branch != "" && e.Branch != opts.branch {
+		return false
+	}
+	if opts.state != "" && e.State != opts.state {
+		return false
+	}
+	if opts.before.raw != "" && !e.Due().Before(opts.before.time) {
+		return false
+	}
+	if opts.after.raw != "" && !e.Due().After(opts.after.time) {
+		return false
+	}
+
+	return true
+}
+
+// Sort the entries by due time, by id (which is the order they were planned in) or by branch then due time
+func sortStatusEntries(rows []statusEntry, by string) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		switch by {
+		case "id":
+			return lessID(rows[i].ID, rows[j].ID)
+		case "branch":
+			if rows[i].Branch != rows[j].Branch {
+				return rows[i].Branch < rows[j].Branch
+			}
+		}
+		if rows[i].DueUnix != rows[j].DueUnix {
+			return rows[i].DueUnix < rows[j].DueUnix
+		}
+		return lessID(rows[i].ID, rows[j].ID)
+	})
+}
+
+// Compare ids in the order they were planned
+// Entries planned by older versions have longer numeric ids, and come first
+func lessID(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+
+	return a < b
+}
+
+// Render the entries as a table, highlight colors the entries being processed or failed
+func renderStatusTable(w io.Writer, rows []statusEntry, invalid []*entryError, now time.Time, highlight bool) {
+	t := table.NewWriter()
+	t.SetOutputMirror(w)
+	if highlight {
+		t.SetRowPainter(func(row table.Row) text.Colors {
+			switch row[len(row)-1] {
+			case stateProcessing:
+				return text.Colors{text.FgYellow, text.Bold}
+			case stateFailed:
+				return text.Colors{text.FgRed}
+			case statePushed:
+				return text.Colors{text.Faint}
+			}
+			return nil
+		})
+	}
+	t.AppendHeader(table.Row{"ID", "Date", "Due", "Branch", "Message", "State"})
+	var next *statusEntry
+	for i, row := range rows {
+		t.AppendRow(table.Row{row.ID, humanDate(row.Due), relativeDate(row.Due, now), row.Branch, row.Message, row.State})
+		if row.State != stateFailed && row.State != statePushed && (next == nil || row.DueUnix < next.DueUnix) {
+			next = &rows[i]
+		}
+	}
+	// A broken entry doesn't prevent the others from being listed
+	for _, e := range invalid {
+		t.AppendRow(table.Row{e.ID, "", "", "", color.Warn.Sprint("warning: " + e.Err.Error()), ""})
+	}
+
+	caption := fmt.Sprintf("%v commit(s)", len(rows))
+	if len(invalid) > 0 {
+		caption += fmt.Sprintf(", %v invalid", len(invalid))
+	}
+	if next != nil {
+		caption += fmt.Sprintf(" - next: %v on %v %v", next.ID, next.Branch, relativeDate(next.Due, now))
+	}
+	t.SetCaption(caption)
+	t.Render()
+}
+
+func writeStatusJSON(w io.Writer, rows []statusEntry) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(rows)
+}
+
+func writeStatusCSV(w io.Writer, rows []statusEntry, separator rune) error {
+	writer := csv.NewWriter(w)
+	writer.Comma = separator
+	writer.Write(statusColumns)
+	for _, row := range rows {
+		writer.Write(row.columns())
 	}
-	humanDate := time.Unix(i, 0)
+	writer.Flush()
+
+	return writer.Error()
+}
+
+func writeStatusMarkdown(w io.Writer, rows []statusEntry) {
+	fmt.Fprintf(w, "| %v |\n", strings.Join(statusColumns, " | "))
+	fmt.Fprintf(w, "|%v\n", strings.Repeat(" --- |", len(statusColumns)))
+	for _, row := range rows {
+		columns := row.columns()
+		for i, c := range columns {
+			c = strings.ReplaceAll(c, "|", `\|`)
+			columns[i] = strings.ReplaceAll(c, "\n", "<br>")
+		}
+		fmt.Fprintf(w, "| %v |\n", strings.Join(columns, " | "))
+	}
+}
 
-	return humanDate.Format("2006-01-02 15:04")
+func humanDate(date time.Time) string {
+	return date.Format("2006-01-02 15:04")
 }
@@ -1,138 +1,229 @@
 package main
 
 import (
-	"io/ioutil"
-	"net"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gen2brain/beeep"
-	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/gookit/color"
-	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 )
 
-// Get the command that is provided in the CLI
-// Can be either commit or consume
-func getCommand() string {
-	for key, val := range os.Args {
-		if key == 1 {
-			return val
-		}
-	}
-	return ""
-}
+var stdin = bufio.NewReader(os.Stdin)
 
-// Retrieve a named parameter provided in the CLI
-// It can be formatted in two ways
-// -param "value" or -param="value"
-func getParam(name string) string {
-	if len(os.Args) < 3 {
-		panic("Not enough arguments")
-	}
-	args := os.Args[2:]
-
-	lookedForKey := "-" + name
-	prevValue := ""
-	for _, value := range args {
-		if strings.Contains(value, "=") {
-			s := strings.Split(value, "=")
-			param, v := s[0], s[1]
-			if param == lookedForKey {
-				return v
-			}
-			prevValue = value
-			continue
-		}
-
-		if prevValue == lookedForKey {
-			return value
-		}
-		prevValue = value
+// Ask a question to the user and return the answer
+// If secret is true, the answer is not echoed on the terminal
+func prompt(question string, secret bool) (string, error) {
+	color.Info.Println(question)
+	if secret && term.IsTerminal(int(os.Stdin.Fd())) {
+		answer, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		return string(answer), err
+	}
+	answer, err := stdin.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && answer != "") {
+		return "", fmt.Errorf("could not read the answer to %q: %w", question, err)
 	}
 
-	color.Error.Printf("Param %v was not found\n", name)
-
-	return ""
+	return strings.TrimRight(answer, "\r\n"), nil
 }
 
-// Send a desktop notification
+// Send a desktop notification, or print a warning when it can't be sent
 // If status is false, it means the notification tells an error
 func Notify(message string, status bool) {
-	if _, err := os.Stat(".gitplan/assets"); os.IsNotExist(err) {
-		os.MkdirAll(".gitplan/assets", 0755)
+	if _, err := os.Stat(assetsDir); os.IsNotExist(err) {
+		os.MkdirAll(assetsDir, 0755)
 	}
-	if _, err := os.Stat(".gitplan/assets/YEP.png"); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(assetsDir, "YEP.png")); os.IsNotExist(err) {
 		file, err := Asset("assets/YEP.png")
 		if err == nil {
-			os.WriteFile(".gitplan/assets/YEP.png", file, 0755)
+			os.WriteFile(filepath.Join(assetsDir, "YEP.png"), file, 0755)
 		}
 	}
-	if _, err := os.Stat(".gitplan/assets/NOP.png"); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(assetsDir, "NOP.png")); os.IsNotExist(err) {
 		file, err := Asset("assets/NOP.png")
 		if err == nil {
-			os.WriteFile(".gitplan/assets/NOP.png", file, 0755)
+			os.WriteFile(filepath.Join(assetsDir, "NOP.png"), file, 0755)
 		}
 	}
-	image := ".gitplan/assets/YEP.png"
+	image := filepath.Join(assetsDir, "YEP.png")
 	if !status {
-		image = ".gitplan/assets/NOP.png"
+		image = filepath.Join(assetsDir, "NOP.png")
 	}
+	// Without a notification daemon (a server, a container), the message is only printed
 	err := beeep.Notify("Gitplan", message, image)
 	if err != nil {
-		panic(err)
+		color.Warn.Println(fmt.Sprintf("Could not send a notification (%v): %v", err, message))
 	}
 }
 
-// Format the date param from CLI which is formatted "+{value}{unit}" (for example +2hours)
-// to have an UNIX timestamp
-func formatDate(date string) string {
-	reg, _ := regexp.Compile("[+]([0-9]+)(hours|hour|minutes|minute)")
-	match := reg.FindAllSubmatch([]byte(date), 2)
+// Parse the date param from CLI which is formatted "+{value}{unit}" (for example +2hours)
+// to have the delay before the commit should be pushed
+func parseDelay(date string) (time.Duration, error) {
+	reg := regexp.MustCompile("^[+]([0-9]+)(hours|hour|minutes|minute)$")
+	match := reg.FindStringSubmatch(date)
+	if match == nil {
+		return 0, fmt.Errorf("invalid date %q, expected something like +2hours or +30minutes", date)
+	}
 
-	amount, _ := strconv.ParseInt(string(match[0][1]), 10, 64)
-	unit := string(match[0][2])
+	amount, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid date %q: %v", date, err)
+	}
+	unit := match[2]
 
-	now := time.Now()
 	imDone := time.Duration(amount)
 	if unit == "hours" || unit == "hour" {
 		imDone = imDone * time.Hour
 	} else {
 		imDone = imDone * time.Minute
 	}
-	finalDate := now.Add(imDone)
 
-	return strconv.FormatInt(finalDate.Unix(), 10)
+	return imDone, nil
+}
+
+// The -date flag, validated as soon as the CLI is parsed
+type delayFlag struct {
+	raw   string
+	delay time.Duration
+}
+
+func (d *delayFlag) String() string {
+	return d.raw
 }
 
-// Generate public keys from private key file and password
-// Password can be an empty string
-func GenerateAuth(privateKeyFile string, password string) (*gitssh.PublicKeys, error) {
-	var signer ssh.Signer
-	var err error = nil
-	sshKey, err := ioutil.ReadFile(privateKeyFile)
+func (d *delayFlag) Set(value string) error {
+	delay, err := parseDelay(value)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if len(password) == 0 {
-		signer, err = ssh.ParsePrivateKey([]byte(sshKey))
-	} else {
-		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(sshKey), []byte(password))
+	d.raw, d.delay = value, delay
+
+	return nil
+}
+
+// UNIX timestamp of the moment the delay is over
+func (d *delayFlag) dueDate() int64 {
+	return time.Now().Add(d.delay).Unix()
+}
+
+// Parse a point in time given in the CLI, either as a delay from now (+2hours)
+// or as a date: RFC3339, "2006-01-02 15:04", "2006-01-02" or "15:04" for today
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if strings.HasPrefix(value, "+") {
+		delay, err := parseDelay(value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(delay), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
 	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02"} {
+		t, err = time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	t, err = time.ParseInLocation("15:04", value, time.Local)
+	if err == nil {
+		return time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q, expected +2hours, 15:04, 2006-01-02 15:04 or RFC3339", value)
+}
+
+// A flag holding a point in time, see parseTime
+type timeFlag struct {
+	raw  string
+	time time.Time
+}
+
+func (t *timeFlag) String() string {
+	return t.raw
+}
+
+func (t *timeFlag) Set(value string) error {
+	parsed, err := parseTime(value, time.Now())
 	if err != nil {
-		return nil, err
+		return err
+	}
+	t.raw, t.time = value, parsed
+
+	return nil
+}
+
+// Describe how far the date is from now, like "in 1h 12m" or "overdue by 3m"
+func relativeDate(date time.Time, now time.Time) string {
+	d := date.Sub(now).Round(time.Second)
+	if d < 0 {
+		return "overdue by " + shortDuration(-d)
 	}
 
-	hostKeyCallback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		return nil
+	return "in " + shortDuration(d)
+}
+
+func shortDuration(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	}
+	hours, minutes := int(d.Hours()), int(d.Minutes())%60
+	if hours == 0 {
+		return fmt.Sprintf("%dm", minutes)
+	}
+	if hours >= 24 {
+		return fmt.Sprintf("%dd %dh", hours/24, hours%24)
 	}
 
-	auth := &gitssh.PublicKeys{User: "git", Signer: signer, HostKeyCallbackHelper: gitssh.HostKeyCallbackHelper{
-		HostKeyCallback: hostKeyCallback,
-	}}
+	return fmt.Sprintf("%dh %dm", hours, minutes)
+}
+
+// Write a file so that it is either fully written or not at all, even if gitplan or the machine crashes:
+// the content goes to a temporary file next to it, synced to the disk, then renamed over it
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// The rename itself is only durable once the directory is synced
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
 
-	return auth, nil
+// Quote the string as a single word for sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2021, 11, 20, 10, 30, 0, 0, time.Local)
+	tests := []struct {
+		value string
+		want  time.Time // zero when an error is expected
+	}{
+		{"+2hours", now.Add(2 * time.Hour)},
+		{"+1hour", now.Add(time.Hour)},
+		{"+30minutes", now.Add(30 * time.Minute)},
+		{"15:04", time.Date(2021, 11, 20, 15, 4, 0, 0, time.Local)},
+		{"08:00", time.Date(2021, 11, 20, 8, 0, 0, 0, time.Local)},
+		{"2021-12-01 09:15", time.Date(2021, 12, 1, 9, 15, 0, 0, time.Local)},
+		{"2021-12-01", time.Date(2021, 12, 1, 0, 0, 0, 0, time.Local)},
+		{"2021-12-01T09:15:00Z", time.Date(2021, 12, 1, 9, 15, 0, 0, time.UTC)},
+		{"+2days", time.Time{}},
+		{"tomorrow", time.Time{}},
+		{"25:00", time.Time{}},
+		{"", time.Time{}},
+	}
+	for _, tt := range tests {
+		got, err := parseTime(tt.value, now)
+		switch {
+		case tt.want.IsZero() && err == nil:
+			t.Errorf("parseTime(%q) = %v, expected an error", tt.value, got)
+		case !tt.want.IsZero() && err != nil:
+			t.Errorf("parseTime(%q) failed: %v", tt.value, err)
+		case !got.Equal(tt.want):
+			t.Errorf("parseTime(%q) = %v, expected %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestShortDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0s"},
+		{42 * time.Second, "42s"},
+		{time.Minute, "1m"},
+		{59*time.Minute + 59*time.Second, "59m"},
+		{90 * time.Minute, "1h 30m"},
+		{23*time.Hour + 5*time.Minute, "23h 5m"},
+		{24 * time.Hour, "1d 0h"},
+		{49*time.Hour + 10*time.Minute, "2d 1h"},
+	}
+	for _, tt := range tests {
+		if got := shortDuration(tt.d); got != tt.want {
+			t.Errorf("shortDuration(%v) = %q, expected %q", tt.d, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gookit/color"
+)
+
+// Redraw the status table in place every second, and as soon as something changes in the queue
+func watchStatus(opts *statusOptions) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	// Without the directory there is nothing to watch yet, the ticker keeps trying until the first commit
+	watching := watcher.Add(commitsDir) == nil
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// Hide the cursor while redrawing, and show it back when leaving
+	os.Stdout.WriteString("\033[?25l\033[2J")
+	defer os.Stdout.WriteString("\033[?25h\n")
+
+	for {
+		err = drawStatus(opts)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-interrupt:
+			return nil
+		case <-ticker.C:
+			if !watching {
+				watching = watcher.Add(commitsDir) == nil
+			}
+		case <-watcher.Events:
+		case err = <-watcher.Errors:
+			return err
+		}
+	}
+}
+
+// Draw the status table over the previous one
+func drawStatus(opts *statusOptions) error {
+	rows, invalid, err := opts.rows()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	buffer := &bytes.Buffer{}
+	buffer.WriteString(color.Comment.Sprintf("Every 1s: gitplan status - %v - press Ctrl+C to quit", now.Format("15:04:05")) + "\n\n")
+	if len(rows) == 0 && len(invalid) == 0 {
+		buffer.WriteString(color.Warn.Sprint("No commit is planned") + "\n")
+	} else {
+		renderStatusTable(buffer, rows, invalid, now, true)
+	}
+
+	// Clear the end of each line and everything below the table, in case the previous one was bigger
+	screen := "\033[H" + strings.ReplaceAll(buffer.String(), "\n", "\033[K\n") + "\033[J"
+	_, err = os.Stdout.WriteString(screen)
+
+	return err
+}